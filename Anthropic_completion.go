@@ -17,12 +17,15 @@ limitations under the License.
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 )
 
 type AnthropicOut_Error struct {
@@ -37,20 +40,40 @@ type AnthropicOut_Usage struct {
 }
 
 type AnthropicOut struct {
-	Role    string
-	Content []Anthropic_completion_msg_Content
-	Error   *AnthropicOut_Error
-	Usage   AnthropicOut_Usage
+	Role        string
+	Content     []Anthropic_completion_msg_Content
+	Error       *AnthropicOut_Error
+	Usage       AnthropicOut_Usage
+	Stop_reason string
 }
 
-func Anthropic_completion_Run(input Anthropic_completion_props, Completion_url string, Api_key string) (AnthropicOut, error) {
+type AnthropicOut_StreamDelta struct {
+	Type         string //"text_delta", "input_json_delta"
+	Text         string
+	Partial_json string
+	Stop_reason  string
+}
+
+// One Server-Sent Event. Type: "message_start", "content_block_start", "content_block_delta", "content_block_stop", "message_delta", "message_stop", "ping", "error"
+type AnthropicOut_Stream struct {
+	Type          string
+	Index         int
+	Message       *AnthropicOut
+	Content_block *Anthropic_completion_msg_Content
+	Delta         AnthropicOut_StreamDelta
+	Usage         *AnthropicOut_Usage
+	Error         *AnthropicOut_Error
+}
+
+// fnStreaming is called with every text delta when input.Stream is true. It can be nil.
+func Anthropic_completion_Run(ctx context.Context, input Anthropic_completion_props, Completion_url string, Api_key string, fnStreaming func(chunk string)) (AnthropicOut, error) {
 	jsProps, err := json.MarshalIndent(input, "", "") //...json.Marshal(input)
 	if err != nil {
 		return AnthropicOut{}, err
 	}
 	body := bytes.NewReader(jsProps)
 
-	req, err := http.NewRequest(http.MethodPost, Completion_url, body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, Completion_url, body)
 	if err != nil {
 		return AnthropicOut{}, fmt.Errorf("NewRequest() failed: %w", err)
 	}
@@ -61,13 +84,22 @@ func Anthropic_completion_Run(input Anthropic_completion_props, Completion_url s
 	client := &http.Client{}
 	res, err := client.Do(req)
 	if err != nil {
-		return AnthropicOut{}, fmt.Errorf("Do() failed: %w", err)
+		return AnthropicOut{}, NewCompletion_errorNetwork(fmt.Errorf("Do() failed: %w", err))
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode != 200 {
+		js, _ := io.ReadAll(res.Body)
+		return AnthropicOut{}, NewCompletion_errorFromResponse(res, js)
+	}
+
+	if input.Stream {
+		return _Anthropic_completion_readStream(res.Body, fnStreaming)
+	}
+
 	js, err := io.ReadAll(res.Body)
 	if err != nil {
-		return AnthropicOut{}, err
+		return AnthropicOut{}, NewCompletion_errorNetwork(err)
 	}
 
 	var out AnthropicOut
@@ -78,8 +110,96 @@ func Anthropic_completion_Run(input Anthropic_completion_props, Completion_url s
 	if out.Error != nil && out.Error.Message != "" {
 		return AnthropicOut{}, errors.New(out.Error.Message)
 	}
-	if res.StatusCode != 200 {
-		return AnthropicOut{}, fmt.Errorf("statusCode %d != 200, response: %s", res.StatusCode, string(js))
-	}
 	return out, nil
 }
+
+// Reads Server-Sent Events and assembles them into one AnthropicOut, same as non-streaming response.
+func _Anthropic_completion_readStream(body io.Reader, fnStreaming func(chunk string)) (AnthropicOut, error) {
+	var out AnthropicOut
+	var inputs []string //tool_use 'input' is sent as partial JSON strings
+
+	rd := bufio.NewReader(body)
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return AnthropicOut{}, NewCompletion_errorNetwork(err) //connection dropped in the middle
+		}
+		if line == "" && err == io.EOF {
+			break
+		}
+
+		data, found := strings.CutPrefix(strings.TrimSpace(line), "data:")
+		data = strings.TrimSpace(data)
+		if !found || data == "" {
+			continue //empty line or 'event:'
+		}
+
+		var ev AnthropicOut_Stream
+		err = json.Unmarshal([]byte(data), &ev)
+		if err != nil {
+			return AnthropicOut{}, fmt.Errorf("%w. %s", err, data)
+		}
+
+		switch ev.Type {
+		case "message_start":
+			if ev.Message != nil {
+				out.Role = ev.Message.Role
+				out.Usage = ev.Message.Usage
+			}
+
+		case "content_block_start":
+			for len(out.Content) <= ev.Index {
+				out.Content = append(out.Content, Anthropic_completion_msg_Content{})
+				inputs = append(inputs, "")
+			}
+			if ev.Content_block != nil {
+				out.Content[ev.Index] = *ev.Content_block
+			}
+
+		case "content_block_delta":
+			if ev.Index >= len(out.Content) {
+				return AnthropicOut{}, fmt.Errorf("content_block_delta index %d out of range", ev.Index)
+			}
+			switch ev.Delta.Type {
+			case "text_delta":
+				out.Content[ev.Index].Text += ev.Delta.Text
+				if fnStreaming != nil {
+					fnStreaming(ev.Delta.Text)
+				}
+			case "input_json_delta":
+				inputs[ev.Index] += ev.Delta.Partial_json
+			}
+
+		case "content_block_stop":
+			if ev.Index < len(out.Content) && out.Content[ev.Index].Type == "tool_use" {
+				input := inputs[ev.Index]
+				if input == "" {
+					input = "{}"
+				}
+				out.Content[ev.Index].Input = json.RawMessage(input)
+			}
+
+		case "message_delta":
+			if ev.Delta.Stop_reason != "" {
+				out.Stop_reason = ev.Delta.Stop_reason
+			}
+			if ev.Usage != nil {
+				out.Usage.Output_tokens = ev.Usage.Output_tokens
+			}
+
+		case "error":
+			//mid-stream errors are "overloaded_error" or "api_error"
+			msg := data
+			if ev.Error != nil {
+				msg = ev.Error.Message
+			}
+			return AnthropicOut{}, &Completion_error{Kind: Completion_error_server, Retryable: true, Message: msg}
+
+		case "message_stop":
+			return out, nil
+		}
+	}
+
+	//connection was closed before 'message_stop', message can be cut
+	return AnthropicOut{}, NewCompletion_errorNetwork(fmt.Errorf("stream ended without message_stop: %w", io.ErrUnexpectedEOF))
+}
@@ -32,10 +32,29 @@ type Anthropic_completion_props struct {
 	Messages []Anthropic_completion_msg `json:"messages"`
 	Stream   bool                       `json:"stream"`
 
-	Tools []*Anthropic_completion_tool `json:"tools,omitempty"`
+	Tools       []*Anthropic_completion_tool     `json:"tools,omitempty"`
+	Tool_choice *Anthropic_completion_toolChoice `json:"tool_choice,omitempty"`
 
 	Temperature float64 `json:"temperature"` //1.0
 	Max_tokens  int     `json:"max_tokens"`
+
+	System_cache bool `json:"-"` //system is sent as text block with cache_control
+}
+
+// "system" is string, or array of blocks when it has cache breakpoint.
+func (props Anthropic_completion_props) MarshalJSON() ([]byte, error) {
+	type plain Anthropic_completion_props //without MarshalJSON()
+	if !props.System_cache || props.System == "" {
+		return json.Marshal(plain(props))
+	}
+
+	return json.Marshal(struct {
+		plain
+		System []Anthropic_completion_msg_Content `json:"system"`
+	}{
+		plain:  plain(props),
+		System: []Anthropic_completion_msg_Content{{Type: "text", Text: props.System, Cache_control: NewAnthropic_completion_cacheControl()}},
+	})
 }
 
 type Anthropic_completion_msg_content_Image struct {
@@ -56,6 +75,17 @@ type Anthropic_completion_msg_Content struct {
 	Input json.RawMessage `json:"input,omitempty"` //{"location": "San Francisco, CA", "unit": "celsius"}
 
 	Source *Anthropic_completion_msg_content_Image `json:"source,omitempty"`
+
+	Cache_control *Anthropic_completion_cacheControl `json:"cache_control,omitempty"`
+}
+
+// Prompt caching. Prefix of request(tools, system, messages) up to block with cache_control is cached.
+type Anthropic_completion_cacheControl struct {
+	Type string `json:"type"` //"ephemeral"
+}
+
+func NewAnthropic_completion_cacheControl() *Anthropic_completion_cacheControl {
+	return &Anthropic_completion_cacheControl{Type: "ephemeral"}
 }
 
 type Anthropic_completion_msg struct {
@@ -91,10 +121,17 @@ func (msg *Anthropic_completion_msg) AddToolResult(tool_use_id string, result st
 	msg.Content = append(msg.Content, Anthropic_completion_msg_Content{Type: "tool_result", Tool_use_id: tool_use_id, Content: result})
 }
 
+type Anthropic_completion_toolChoice struct {
+	Type                      string `json:"type"` //"auto"
+	Disable_parallel_tool_use bool   `json:"disable_parallel_tool_use,omitempty"`
+}
+
 type Anthropic_completion_tool struct {
 	Name         string                        `json:"name"`
 	Description  string                        `json:"description"`
 	Input_schema OpenAI_completion_tool_schema `json:"input_schema"`
+
+	Cache_control *Anthropic_completion_cacheControl `json:"cache_control,omitempty"`
 }
 
 func NewAnthropic_completion_tool(name, description string) *Anthropic_completion_tool {
@@ -107,8 +144,76 @@ func NewAnthropic_completion_tool(name, description string) *Anthropic_completio
 
 func (props *Anthropic_completion_props) ResetDefault() {
 	props.Model = "claude-3-5-haiku-latest"
-	props.Stream = false
+	props.Stream = true
 	props.Temperature = 0.2
 	props.Max_tokens = 4046
 	//props.Seed = -1
 }
+
+// Returns copy of props, which model can handle. Unsupported tools, images and streaming are removed, Max_tokens is clamped.
+func (props *Anthropic_completion_props) AdaptToModel(caps *ModelCaps) Anthropic_completion_props {
+	out := *props
+
+	if !caps.Tools {
+		out.Tools = nil
+	}
+	out.Tool_choice = nil
+	if len(out.Tools) > 0 && !caps.Parallel_tools {
+		out.Tool_choice = &Anthropic_completion_toolChoice{Type: "auto", Disable_parallel_tool_use: true}
+	}
+	if caps.Max_output_tokens > 0 && out.Max_tokens > caps.Max_output_tokens {
+		out.Max_tokens = caps.Max_output_tokens
+	}
+	if !caps.Streaming {
+		out.Stream = false
+	}
+
+	if caps.Vision && caps.System_prompt != ModelCaps_system_user {
+		return out
+	}
+
+	system := ""
+	if caps.System_prompt == ModelCaps_system_user {
+		system = out.System
+		out.System = ""
+	}
+	out.Messages = nil
+	for _, msg := range props.Messages {
+		if msg.Role == "user" {
+			var content []Anthropic_completion_msg_Content
+			if system != "" {
+				content = append(content, Anthropic_completion_msg_Content{Type: "text", Text: system})
+				system = ""
+			}
+			for _, it := range msg.Content {
+				if it.Type == "image" && !caps.Vision {
+					it = Anthropic_completion_msg_Content{Type: "text", Text: "(image was removed, model can't see images)"}
+				}
+				content = append(content, it)
+			}
+			msg.Content = content
+		}
+		out.Messages = append(out.Messages, msg)
+	}
+	return out
+}
+
+// Marks cache breakpoints on the last tool, system and the last message, so next request reads the same prefix from cache. Props must be a copy(AdaptToModel()), agent's tools and messages are not changed.
+func (props *Anthropic_completion_props) AddCacheBreakpoints() {
+	if n := len(props.Tools); n > 0 {
+		props.Tools = append([]*Anthropic_completion_tool{}, props.Tools...)
+		tool := *props.Tools[n-1]
+		tool.Cache_control = NewAnthropic_completion_cacheControl()
+		props.Tools[n-1] = &tool
+	}
+
+	props.System_cache = props.System != ""
+
+	//conversation up to the last message doesn't change in next turn
+	if n := len(props.Messages); n > 0 && len(props.Messages[n-1].Content) > 0 {
+		props.Messages = append([]Anthropic_completion_msg{}, props.Messages...)
+		msg := &props.Messages[n-1]
+		msg.Content = append([]Anthropic_completion_msg_Content{}, msg.Content...)
+		msg.Content[len(msg.Content)-1].Cache_control = NewAnthropic_completion_cacheControl()
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func _testCache_props(tools int, system string, msgs int) Anthropic_completion_props {
+	var props Anthropic_completion_props
+	props.ResetDefault()
+	props.System = system
+	for i := 0; i < tools; i++ {
+		props.Tools = append(props.Tools, NewAnthropic_completion_tool(fmt.Sprintf("tool_%d", i), "Test tool"))
+	}
+	for i := 0; i < msgs; i++ {
+		msg := Anthropic_completion_msg{Role: "user"}
+		if i%2 == 1 {
+			msg.Role = "assistant"
+		}
+		msg.AddText(fmt.Sprintf("first %d", i))
+		msg.AddText(fmt.Sprintf("second %d", i))
+		props.Messages = append(props.Messages, msg)
+	}
+	return props
+}
+
+func TestAnthropicCacheBreakpoints(t *testing.T) {
+	caps := ModelCaps{Tools: true, Parallel_tools: true, Vision: true, Streaming: true}
+
+	tests := []struct {
+		name    string
+		props   Anthropic_completion_props
+		noCache bool
+
+		want      int  //number of breakpoints
+		lastTool  bool //breakpoint on the last tool
+		system    bool
+		lastBlock bool //breakpoint on the last block of the last message
+	}{
+		{"everything", _testCache_props(3, "Be brief.", 4), false, 3, true, true, true},
+		{"no tools", _testCache_props(0, "Be brief.", 2), false, 2, false, true, true},
+		{"no system", _testCache_props(2, "", 1), false, 2, true, false, true},
+		{"no messages", _testCache_props(2, "Be brief.", 0), false, 2, true, true, false},
+		{"empty", _testCache_props(0, "", 0), false, 0, false, false, false},
+		{"no_prompt_cache", _testCache_props(3, "Be brief.", 4), true, 0, false, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orig, _ := json.Marshal(tt.props)
+			out := _agent_anthropicRequest(&tt.props, &caps, &Service{No_prompt_cache: tt.noCache})
+
+			//agent's props stay without breakpoints
+			if after, _ := json.Marshal(tt.props); string(after) != string(orig) || strings.Contains(string(orig), "cache_control") {
+				t.Fatalf("original props were changed: %s", after)
+			}
+
+			js, err := json.Marshal(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := strings.Count(string(js), `"cache_control":{"type":"ephemeral"}`); n != tt.want {
+				t.Errorf("%d breakpoints, want %d: %s", n, tt.want, js)
+			}
+
+			for i, tool := range out.Tools {
+				if (tool.Cache_control != nil) != (tt.lastTool && i == len(out.Tools)-1) {
+					t.Errorf("tool %d: cache_control %v", i, tool.Cache_control)
+				}
+			}
+			if tt.system != strings.Contains(string(js), `"system":[{"type":"text","text":"Be brief.","cache_control":{"type":"ephemeral"}}]`) {
+				t.Errorf("system: %s", js)
+			}
+			for i, msg := range out.Messages {
+				for j, block := range msg.Content {
+					last := i == len(out.Messages)-1 && j == len(msg.Content)-1
+					if (block.Cache_control != nil) != (tt.lastBlock && last) {
+						t.Errorf("message %d block %d: cache_control %v", i, j, block.Cache_control)
+					}
+				}
+			}
+		})
+	}
+}
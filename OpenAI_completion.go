@@ -17,12 +17,15 @@ limitations under the License.
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 )
 
 type OpenAI_completion_out struct {
@@ -31,14 +34,30 @@ type OpenAI_completion_out struct {
 	Tool_calls []OpenAI_completion_msg_Content_ToolCall
 }
 
+type OpenAIOutDelta_ToolCall struct {
+	Index    int
+	Id       string
+	Type     string
+	Function OpenAI_completion_msg_Content_ToolCall_Function
+}
+type OpenAIOutDelta struct {
+	Content    string
+	Tool_calls []OpenAIOutDelta_ToolCall
+}
+
 type OpenAIOutChoice struct {
 	Message OpenAI_completion_out
-	//Delta   STMsg
+	Delta   OpenAIOutDelta //streaming
 }
 type OpenAIOutUsage struct {
-	Prompt_tokens     int
+	Prompt_tokens     int //with cached tokens
 	Completion_tokens int
 	Total_tokens      int
+
+	Prompt_tokens_details *OpenAIOutUsage_PromptDetails
+}
+type OpenAIOutUsage_PromptDetails struct {
+	Cached_tokens int
 }
 type OpenAIOutError struct {
 	Message string
@@ -50,14 +69,15 @@ type OpenAIOut struct {
 	Error     *OpenAIOutError
 }
 
-func OpenAI_completion_Run(input OpenAI_completion_props, Completion_url string, Api_key string) (OpenAIOut, error) {
+// fnStreaming is called with every text delta when input.Stream is true. It can be nil.
+func OpenAI_completion_Run(ctx context.Context, input OpenAI_completion_props, Completion_url string, Api_key string, fnStreaming func(chunk string)) (OpenAIOut, error) {
 	jsProps, err := json.Marshal(input)
 	if err != nil {
 		return OpenAIOut{}, err
 	}
 	body := bytes.NewReader(jsProps)
 
-	req, err := http.NewRequest(http.MethodPost, Completion_url, body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, Completion_url, body)
 	if err != nil {
 		return OpenAIOut{}, fmt.Errorf("NewRequest() failed: %w", err)
 	}
@@ -67,13 +87,22 @@ func OpenAI_completion_Run(input OpenAI_completion_props, Completion_url string,
 	client := &http.Client{}
 	res, err := client.Do(req)
 	if err != nil {
-		return OpenAIOut{}, fmt.Errorf("Do() failed: %w", err)
+		return OpenAIOut{}, NewCompletion_errorNetwork(fmt.Errorf("Do() failed: %w", err))
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode != 200 {
+		js, _ := io.ReadAll(res.Body)
+		return OpenAIOut{}, NewCompletion_errorFromResponse(res, js)
+	}
+
+	if input.Stream {
+		return _OpenAI_completion_readStream(res.Body, fnStreaming)
+	}
+
 	js, err := io.ReadAll(res.Body)
 	if err != nil {
-		return OpenAIOut{}, err
+		return OpenAIOut{}, NewCompletion_errorNetwork(err)
 	}
 
 	if len(js) == 0 {
@@ -89,9 +118,79 @@ func OpenAI_completion_Run(input OpenAI_completion_props, Completion_url string,
 		return OpenAIOut{}, errors.New(out.Error.Message)
 	}
 
-	if res.StatusCode != 200 {
-		return OpenAIOut{}, fmt.Errorf("statusCode %d != 200, response: %s", res.StatusCode, string(js))
+	return out, nil
+}
+
+// Reads Server-Sent Events("data: {...}") and assembles them into one OpenAIOut, same as non-streaming response.
+func _OpenAI_completion_readStream(body io.Reader, fnStreaming func(chunk string)) (OpenAIOut, error) {
+	out := OpenAIOut{Choices: []OpenAIOutChoice{{}}}
+	msg := &out.Choices[0].Message
+
+	rd := bufio.NewReader(body)
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return OpenAIOut{}, NewCompletion_errorNetwork(err) //connection dropped in the middle
+		}
+		if line == "" && err == io.EOF {
+			break
+		}
+
+		data, found := strings.CutPrefix(strings.TrimSpace(line), "data:")
+		data = strings.TrimSpace(data)
+		if !found || data == "" {
+			continue //empty line, comment or 'event:'
+		}
+		if data == "[DONE]" {
+			return out, nil
+		}
+
+		var chunk OpenAIOut
+		err = json.Unmarshal([]byte(data), &chunk)
+		if err != nil {
+			return OpenAIOut{}, fmt.Errorf("%w. %s", err, data)
+		}
+		if chunk.Error != nil && chunk.Error.Message != "" {
+			return OpenAIOut{}, &Completion_error{Kind: Completion_error_server, Retryable: true, Message: chunk.Error.Message} //mid-stream error
+		}
+
+		if len(chunk.Citations) > 0 {
+			out.Citations = chunk.Citations
+		}
+		if chunk.Usage.Total_tokens > 0 || chunk.Usage.Prompt_tokens > 0 {
+			out.Usage = chunk.Usage //last chunk(stream_options.include_usage)
+		}
+
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+		delta := chunk.Choices[0].Delta
+
+		//text
+		if delta.Content != "" {
+			msg.Content += delta.Content
+			if fnStreaming != nil {
+				fnStreaming(delta.Content)
+			}
+		}
+
+		//tool calls are sent in parts, 'index' says which one
+		for _, dt := range delta.Tool_calls {
+			for len(msg.Tool_calls) <= dt.Index {
+				msg.Tool_calls = append(msg.Tool_calls, OpenAI_completion_msg_Content_ToolCall{})
+			}
+			call := &msg.Tool_calls[dt.Index]
+			if dt.Id != "" {
+				call.Id = dt.Id
+			}
+			if dt.Type != "" {
+				call.Type = dt.Type
+			}
+			call.Function.Name += dt.Function.Name
+			call.Function.Arguments += dt.Function.Arguments
+		}
 	}
 
-	return out, nil
+	//connection was closed before '[DONE]', message can be cut
+	return OpenAIOut{}, NewCompletion_errorNetwork(fmt.Errorf("stream ended without [DONE]: %w", io.ErrUnexpectedEOF))
 }
@@ -18,6 +18,7 @@ package main
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -29,7 +30,10 @@ type OpenAI_completion_props struct {
 	Messages []interface{} `json:"messages"` //OpenAI_completion_msgPlain, OpenAI_completion_msg, OpenAI_completion_msgCalls, OpenAI_completion_msgResult
 	Stream   bool          `json:"stream"`
 
-	Tools []*OpenAI_completion_tool `json:"tools,omitempty"`
+	Stream_options *OpenAI_completion_stream_options `json:"stream_options,omitempty"`
+
+	Tools               []*OpenAI_completion_tool `json:"tools,omitempty"`
+	Parallel_tool_calls *bool                     `json:"parallel_tool_calls,omitempty"` //nil = provider's default(true)
 
 	Temperature       float64 `json:"temperature"`                 //1.0
 	Max_tokens        int     `json:"max_tokens"`                  //
@@ -171,6 +175,10 @@ func (msg *OpenAI_completion_msg) AddImageFile(path string) error {
 	return nil
 }
 
+type OpenAI_completion_stream_options struct {
+	Include_usage bool `json:"include_usage"` //last chunk has usage
+}
+
 type OpenAI_completion_format struct {
 	Type string `json:"type"` //json_object
 	//Json_schema ...
@@ -178,7 +186,8 @@ type OpenAI_completion_format struct {
 
 func (props *OpenAI_completion_props) ResetDefault() {
 	props.Model = "gpt-4o-mini"
-	props.Stream = false
+	props.Stream = true
+	props.Stream_options = &OpenAI_completion_stream_options{Include_usage: true}
 	props.Temperature = 0.2
 	props.Max_tokens = 4046
 	props.Top_p = 0.7 //1.0
@@ -191,3 +200,77 @@ func (props *OpenAI_completion_props) ResetSearch() {
 	props.ResetDefault()
 	props.Frequency_penalty = 1
 }
+
+// Returns copy of props, which model can handle. Unsupported tools, images, streaming and response format are removed, Max_tokens is clamped.
+func (props *OpenAI_completion_props) AdaptToModel(caps *ModelCaps) OpenAI_completion_props {
+	out := *props
+
+	if !caps.Tools {
+		out.Tools = nil
+	}
+	out.Parallel_tool_calls = nil
+	if len(out.Tools) > 0 && !caps.Parallel_tools {
+		parallel := false
+		out.Parallel_tool_calls = &parallel
+	}
+	if caps.Max_output_tokens > 0 && out.Max_tokens > caps.Max_output_tokens {
+		out.Max_tokens = caps.Max_output_tokens
+	}
+	if !caps.Streaming {
+		out.Stream = false
+		out.Stream_options = nil
+	}
+	if !caps.Json_schema {
+		out.Response_format = nil
+	}
+
+	if caps.Vision && caps.System_prompt != ModelCaps_system_user {
+		return out
+	}
+
+	//messages can be map[string]interface{} after Agent.Open(), so they are re-decoded
+	out.Messages = nil
+	system := ""
+	for _, it := range props.Messages {
+		js, err := json.Marshal(it)
+		if err != nil {
+			out.Messages = append(out.Messages, it)
+			continue
+		}
+		var msg _convert_openAIMsg
+		json.Unmarshal(js, &msg)
+
+		var text string
+		var parts []OpenAI_completion_msg_Content
+		if json.Unmarshal(msg.Content, &text) != nil {
+			json.Unmarshal(msg.Content, &parts)
+		}
+
+		switch {
+		case msg.Role == "system" && caps.System_prompt == ModelCaps_system_user:
+			system += text + "\n\n"
+
+		case msg.Role == "user" && (system != "" || (!caps.Vision && strings.Contains(string(msg.Content), `"image_url"`))):
+			um := OpenAI_completion_msg{Role: "user"}
+			if system != "" {
+				um.AddText(strings.TrimSpace(system))
+				system = ""
+			}
+			if text != "" {
+				um.AddText(text)
+			}
+			for _, part := range parts {
+				if part.Type == "image_url" && !caps.Vision {
+					um.AddText("(image was removed, model can't see images)")
+					continue
+				}
+				um.Content = append(um.Content, part)
+			}
+			out.Messages = append(out.Messages, um)
+
+		default:
+			out.Messages = append(out.Messages, it)
+		}
+	}
+	return out
+}
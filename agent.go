@@ -17,14 +17,16 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"go/token"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -32,8 +34,10 @@ type Agent struct {
 	server    *NetServer
 	passwords *Passwords
 
-	Folder string
-	Model  string
+	Folder   string
+	Model    string   //current model
+	Use_case string   //"agent", "coder", "search" or any from models.json
+	Models   []string //fallback chain from use case
 
 	Anthropic_props Anthropic_completion_props
 	OpenAI_props    OpenAI_completion_props
@@ -44,9 +48,70 @@ type Agent struct {
 	TotalTime    float64
 
 	Sandbox_violations []string
+
+	Tool_calls []AgentToolCall
+
+	Secret_accesses []AgentSecretAccess
+
+	LLM_calls  []AgentLLMCall
+	Sub_agents []AgentLedger //usage of sub-agents created by tools
+
+	tool_limits     ToolLimits //global limits, tool.json can make them stricter
+	parallel_tools  bool       //run tool calls from one LLM answer at the same time
+	depth           int        //0 = main agent, sub-agent created by SDK_RunAgent() has +1
+	sandbox_policy  *SandboxPolicy
+	isolate_tools   bool          //run tools in Linux namespaces with seccomp
+	approval        *ApprovalGate //nil = tool calls are allowed, sandbox violations are blocked
+	confirm_secrets bool          //operator confirms the first SDK_GetPassword() of every tool and password_id
+	redactor        *Redactor     //nil = no masking
+	budget          *Budget       //shared by the whole agent tree, nil = no limit
+	budget_warned   bool          //model was told, that budget is almost used
+
+	lock sync.Mutex //tools running in parallel can add tools or report violations
+}
+
+// One tool run with captured output.
+type AgentToolCall struct {
+	Tool      string
+	Arguments string
+	Result    string
+	Stdout    string
+	Stderr    string
+
+	Start_time int64   //unix seconds
+	Duration   float64 //seconds
+}
+
+// SDK_GetPassword() call, password itself is not saved.
+type AgentSecretAccess struct {
+	Tool    string
+	Id      string
+	Time    int64 //unix seconds
+	Allowed bool
+	Reason  string `json:",omitempty"` //why it was denied
+}
+
+// AgentResult.Stop_reason
+const (
+	AgentStop_finished       = "finished"   //LLM answered without tool calls
+	AgentStop_max_iters      = "max_iters"  //RunLoop(max_iters)
+	AgentStop_max_tokens     = "max_tokens" //RunLoop(max_tokens)
+	AgentStop_provider_error = "provider_error"
+	AgentStop_cancelled      = "cancelled" //Ctrl-C
+	AgentStop_deadline       = "deadline"  //context deadline
+	AgentStop_budget         = "budget"    //shared Budget was used
+)
+
+type AgentResult struct {
+	Stop_reason   string
+	Final_message string
+
+	InputTokens  int
+	OutputTokens int
+	TotalTokens  int
 }
 
-func NewAgent(folder string, use_case string, systemPrompt string, userPrompt string, server *NetServer, passwords *Passwords) *Agent {
+func NewAgent(folder string, use_case string, systemPrompt string, userPrompt string, server *NetServer, passwords *Passwords) (*Agent, error) {
 
 	if systemPrompt == "" {
 		systemPrompt = `You are an AI tool calling assistant, who enjoys precision and carefully follows the user's requirements."
@@ -61,8 +126,20 @@ Tool parameter values must be real, don't use placeholder(aka example.com) and d
 `
 	}
 
-	model := Service_findModelFromUse_cases(use_case)
-	agent := &Agent{Folder: folder, Model: model, server: server, passwords: passwords}
+	toolList, err := GetToolsList(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	models := Service_findModelsFromUse_case(use_case)
+	model := _agent_pickModel(models, len(toolList) > 0, false, 0)
+	if model == "" {
+		model = models[0]
+	}
+	if Service_findService(model) == nil {
+		return nil, fmt.Errorf("model %s not found. Edit models.json", model)
+	}
+	agent := &Agent{Folder: folder, Model: model, Use_case: strings.ToLower(use_case), Models: models, server: server, passwords: passwords, sandbox_policy: NewSandboxPolicy()}
 
 	if agent.IsModelAnthropic() {
 		agent.Anthropic_props.ResetDefault()
@@ -96,11 +173,6 @@ Tool parameter values must be real, don't use placeholder(aka example.com) and d
 		}
 	}
 
-	toolList, err := GetToolsList(folder)
-	if err != nil {
-		log.Fatal(err)
-	}
-
 	for _, toolName := range toolList {
 		path := filepath.Join(folder, toolName)
 		if NeedCompileTool(path) {
@@ -110,16 +182,20 @@ Tool parameter values must be real, don't use placeholder(aka example.com) and d
 				continue
 			}
 		}
-		agent.AddTool(path)
+		err = agent.AddTool(path)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return agent
+	return agent, nil
 }
 
+// Model existence is checked in NewAgent(), unknown model is treated as OpenAI-compatible.
 func (agent *Agent) IsModelAnthropic() bool {
 	service := Service_findService(agent.Model)
 	if service == nil {
-		log.Fatalf("model %s not found.", agent.Model)
+		return false
 	}
 
 	return service.Anthropic_completion_url != ""
@@ -143,6 +219,7 @@ func (agent *Agent) Save(save_as_last bool) error {
 	if err != nil {
 		return err
 	}
+	js = agent.redactor.JSON(js)
 
 	err = os.WriteFile(fmt.Sprintf("%d.json", time.Now().UnixMicro()), js, 0644)
 	if err != nil {
@@ -159,24 +236,27 @@ func (agent *Agent) Save(save_as_last bool) error {
 	return nil
 }
 
-func (agent *Agent) AddTool(tool string) {
+func (agent *Agent) AddTool(tool string) error {
 	if NeedCompileTool(tool) { //must be compiled
 		fmt.Printf("Tool '%s' can't be add because it's not compiled\n", tool)
-		return
+		return nil
 	}
 
 	openaiAPI, anthropicAPI, err := ConvertFileIntoTool(tool)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("tool '%s': %w", tool, err)
 	}
 
+	agent.lock.Lock()
+	defer agent.lock.Unlock()
+
 	toolName := filepath.Base(tool)
 	if agent.IsModelAnthropic() {
 		//update
 		for i, tool := range agent.Anthropic_props.Tools {
 			if tool.Name == toolName {
 				agent.Anthropic_props.Tools[i] = anthropicAPI
-				return
+				return nil
 			}
 		}
 		//add
@@ -187,12 +267,13 @@ func (agent *Agent) AddTool(tool string) {
 		for i, tool := range agent.OpenAI_props.Tools {
 			if tool.Function.Name == toolName {
 				agent.OpenAI_props.Tools[i] = openaiAPI
-				return
+				return nil
 			}
 		}
 		//add
 		agent.OpenAI_props.Tools = append(agent.OpenAI_props.Tools, openaiAPI)
 	}
+	return nil
 }
 
 func (agent *Agent) GetFinalMessage() string {
@@ -243,14 +324,17 @@ func (agent *Agent) PrintStats() {
 		fmt.Println("Toks/sec:", float64(agent.OutputTokens)/agent.TotalTime)
 	}
 
-	model := Service_findModel(agent.Model)
-	if model != nil {
-		input_price := model.Input_price / 1000000
-		output_price := model.Output_price / 1000000
-
-		price := float64(agent.InputTokens)*input_price + float64(agent.OutputTokens)*output_price
-		fmt.Printf("Price: $%f\n", price)
-		fmt.Printf("Runs per $1: %dx\n", int(1/price))
+	ledger := agent.getLedger("")
+	own := ledger.Own()
+	fmt.Println("Tokens(cache write, cache read):", own.Cache_write_tokens, own.Cache_read_tokens)
+	fmt.Printf("Cache hit ratio: %.1f%%\n", own.CacheHitRatio()*100)
+	fmt.Println("LLM calls:", own.Calls)
+	fmt.Printf("Price: $%f\n", own.Cost)
+	if len(ledger.Sub_agents) > 0 {
+		fmt.Printf("Price with sub-agents: $%f\n", ledger.Total().Cost)
+	}
+	if own.Cost > 0 {
+		fmt.Printf("Runs per $1: %dx\n", int(1/own.Cost))
 	}
 
 	fmt.Println("Sandbox violations:", len(agent.Sandbox_violations))
@@ -258,25 +342,233 @@ func (agent *Agent) PrintStats() {
 		fmt.Printf("- %s\n", it)
 	}
 
+	fmt.Println("Password accesses:", len(agent.Secret_accesses))
+	for _, it := range agent.Secret_accesses {
+		if it.Allowed {
+			fmt.Printf("- %s: %s allowed\n", it.Tool, it.Id)
+		} else {
+			fmt.Printf("- %s: %s denied(%s)\n", it.Tool, it.Id, it.Reason)
+		}
+	}
+
 	fmt.Println("--- ---")
 }
 
-func (agent *Agent) Run() bool {
+// Returns true if LLM called tools and loop should continue. When model fails, the next one from Models is used.
+func (agent *Agent) Run(ctx context.Context) (bool, error) {
+	for {
+		called, err := agent.runModel(ctx)
+		if err == nil || ctx.Err() != nil {
+			return called, err
+		}
+
+		if agent.budget.Exceeded() != "" {
+			return called, err //fallback would cost more
+		}
+		if !_agent_canFallback(err) {
+			return called, err
+		}
+		next := agent.nextModel()
+		if next == "" {
+			return called, err
+		}
+		fmt.Printf("Warning: model '%s' failed(%v), falling back to '%s'\n", agent.Model, err, next)
+		err = agent.SetModel(next)
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// Only provider's problems can be solved by other model. Bad api_key or request would fail the same way.
+func _agent_canFallback(err error) bool {
+	var cerr *Completion_error
+	if !errors.As(err, &cerr) {
+		return false
+	}
+	switch cerr.Kind {
+	case Completion_error_network, Completion_error_rate_limit, Completion_error_overloaded, Completion_error_server, Completion_error_context_length:
+		return true
+	}
+	return false
+}
+
+// Returns next model from Models, which has api_key and can handle the conversation. "" = no more models.
+func (agent *Agent) nextModel() string {
+	for i, model := range agent.Models {
+		if model == agent.Model {
+			tools, vision, tokens := agent.getNeeds()
+			return _agent_pickModel(agent.Models[i+1:], tools, vision, tokens)
+		}
+	}
+	return ""
+}
+
+// Returns what model must support: tools, images and estimated size of the conversation.
+func (agent *Agent) getNeeds() (tools bool, vision bool, tokens int) {
+	var js []byte
+	if agent.IsModelAnthropic() {
+		tools = len(agent.Anthropic_props.Tools) > 0
+		js, _ = json.Marshal(agent.Anthropic_props)
+	} else {
+		tools = len(agent.OpenAI_props.Tools) > 0
+		js, _ = json.Marshal(agent.OpenAI_props)
+	}
+	vision = strings.Contains(string(js), `"image_url"`) || strings.Contains(string(js), `"type":"image"`)
+	return tools, vision, _agent_estimateTokens(js)
+}
+
+// Returns the first model with api_key, which has needed capabilities. When no model has them, the first model with api_key is returned. "" = no model has api_key.
+func _agent_pickModel(models []string, tools bool, vision bool, tokens int) string {
+	first := ""
+	for _, model := range models {
+		if !Service_isReady(Service_findService(model)) {
+			continue
+		}
+		if first == "" {
+			first = model
+		}
+		caps := Service_findModelCaps(model)
+		if (!tools || caps.Tools) && (!vision || caps.Vision) && (caps.Context_tokens == 0 || tokens <= caps.Context_tokens) {
+			return model
+		}
+	}
+	if first != "" {
+		fmt.Printf("Warning: no model from %v can handle tools=%v, images=%v, ~%d tokens, using '%s'\n", models, tools, vision, tokens, first)
+	}
+	return first
+}
+
+// Rough estimate, ~4 bytes of JSON per token.
+func _agent_estimateTokens(js []byte) int {
+	return len(js) / 4
+}
+
+// Returns copy of props adapted to model. Cache breakpoints are added, if service doesn't disable them.
+func _agent_anthropicRequest(props *Anthropic_completion_props, caps *ModelCaps, service *Service) Anthropic_completion_props {
+	out := props.AdaptToModel(caps)
+	if !service.No_prompt_cache {
+		out.AddCacheBreakpoints()
+	}
+	return out
+}
+
+// Request which surely doesn't fit into context is not sent, so next model can be used.
+func _agent_checkContext(props interface{}, model string, caps *ModelCaps) error {
+	if caps.Context_tokens <= 0 {
+		return nil
+	}
+	js, err := json.Marshal(props)
+	if err != nil {
+		return err
+	}
+	tokens := _agent_estimateTokens(js)
+	if tokens > caps.Context_tokens {
+		return &Completion_error{Kind: Completion_error_context_length, Message: fmt.Sprintf("request has ~%d tokens, model '%s' has context of %d tokens", tokens, model, caps.Context_tokens)}
+	}
+	return nil
+}
+
+// Switches to other model. When service has different API, messages and tools are converted.
+func (agent *Agent) SetModel(model string) error {
+	service := Service_findService(model)
+	if service == nil {
+		return fmt.Errorf("model %s not found. Edit models.json", model)
+	}
+
+	agent.lock.Lock()
+	defer agent.lock.Unlock()
+
+	toAnthropic := service.Anthropic_completion_url != ""
+	if toAnthropic && !agent.IsModelAnthropic() {
+		var props Anthropic_completion_props
+		props.ResetDefault()
+		err := Completion_convertToAnthropic(&agent.OpenAI_props, &props)
+		if err != nil {
+			return err
+		}
+		agent.Anthropic_props = props
+		agent.OpenAI_props = OpenAI_completion_props{}
+
+	} else if !toAnthropic && agent.IsModelAnthropic() {
+		var props OpenAI_completion_props
+		if agent.Use_case == "search" {
+			props.ResetSearch()
+		} else {
+			props.ResetDefault()
+		}
+		err := Completion_convertToOpenAI(&agent.Anthropic_props, &props)
+		if err != nil {
+			return err
+		}
+		agent.OpenAI_props = props
+		agent.Anthropic_props = Anthropic_completion_props{}
+	}
+
+	agent.Model = model
+	if toAnthropic {
+		agent.Anthropic_props.Model = model
+	} else {
+		agent.OpenAI_props.Model = model
+	}
+	return nil
+}
+
+func (agent *Agent) runModel(ctx context.Context) (bool, error) {
+	callStart := time.Now()
 	service := Service_findService(agent.Model)
 	if service == nil {
-		log.Fatal(fmt.Errorf("model %s not found. Edit g_services", agent.Model))
+		err := fmt.Errorf("model %s not found. Edit models.json", agent.Model)
+		agent.addLLMCall(callStart, AgentUsage{}, err)
+		return false, err
 	}
 
-	if service.Api_key == "<your_api_key>" {
-		log.Fatal(fmt.Errorf("no api_key for service '%s'", service.Name))
+	if !Service_isReady(service) {
+		err := fmt.Errorf("no api_key for service '%s', set %s or Api_key in models.json", service.Name, Service_envName(service.Name, "API_KEY"))
+		agent.addLLMCall(callStart, AgentUsage{}, err)
+		return false, err
 	}
 
+	//print tokens as they arrive, end is held back until it can't be a part of secret
+	streamed := false
+	stream := NewRedactorStream(agent.redactor)
+	fnStreaming := func(chunk string) {
+		if !streamed {
+			fmt.Printf("+LLM(%s) streaming: ", agent.Folder)
+			streamed = true
+		}
+		fmt.Print(stream.Write(chunk))
+	}
+
+	caps := Service_findModelCaps(agent.Model)
+
 	if agent.IsModelAnthropic() {
 		startTime := float64(time.Now().UnixMilli()) / 1000
 
-		out, err := Anthropic_completion_Run(agent.Anthropic_props, service.Anthropic_completion_url, service.Api_key)
+		props := _agent_anthropicRequest(&agent.Anthropic_props, caps, service)
+		err := _agent_checkContext(props, agent.Model, caps)
 		if err != nil {
-			log.Fatal(err)
+			agent.addLLMCall(callStart, AgentUsage{}, err)
+			return false, err
+		}
+
+		var out AnthropicOut
+		err = Completion_retry(ctx, service, func() error {
+			if streamed {
+				fmt.Println(stream.Flush())
+				streamed = false
+			}
+			var err error
+			out, err = Anthropic_completion_Run(ctx, props, service.Anthropic_completion_url, service.Api_key, fnStreaming)
+			return err
+		})
+		usage := AgentUsage{Input_tokens: out.Usage.Input_tokens, Cache_write_tokens: out.Usage.Cache_creation_input_tokens, Cache_read_tokens: out.Usage.Cache_read_input_tokens, Output_tokens: out.Usage.Output_tokens}
+		agent.addLLMCall(callStart, usage, err)
+		if err != nil {
+			return false, err
+		}
+		if streamed {
+			fmt.Println(stream.Flush())
 		}
 
 		dt := (float64(time.Now().UnixMilli()) / 1000) - startTime
@@ -292,7 +584,7 @@ func (agent *Agent) Run() bool {
 				case "tool_use":
 					args, err := it.Input.MarshalJSON()
 					if err != nil {
-						log.Fatal(err)
+						return false, err
 					}
 					fn := OpenAI_completion_msg_Content_ToolCall_Function{Name: it.Name, Arguments: string(args)}
 					tool_calls = append(tool_calls, OpenAI_completion_msg_Content_ToolCall{Id: it.Id, Type: it.Type, Function: fn})
@@ -300,27 +592,53 @@ func (agent *Agent) Run() bool {
 			}
 		}
 
-		agent.InputTokens += out.Usage.Input_tokens
-		agent.OutputTokens += out.Usage.Output_tokens
-		agent.TotalTokens += out.Usage.Input_tokens + out.Usage.Output_tokens
+		input_tokens := usage.Input_tokens + usage.Cache_write_tokens + usage.Cache_read_tokens
+		agent.InputTokens += input_tokens
+		agent.OutputTokens += usage.Output_tokens
+		agent.TotalTokens += input_tokens + usage.Output_tokens
 		agent.TotalTime += dt
 
 		fmt.Printf("+LLM(%s) generated %dtoks which took %.1fsec = %.1f toks/sec\n", agent.Folder, out.Usage.Output_tokens, dt, float64(out.Usage.Output_tokens)/dt)
-		fmt.Printf("+LLM(%s) returns content: %s\n", agent.Folder, content)
-		fmt.Printf("+LLM(%s) returns tool_calls: %v\n", agent.Folder, tool_calls)
+		fmt.Printf("+LLM(%s) returns content: %s\n", agent.Folder, agent.redactor.String(content))
+		fmt.Printf("+LLM(%s) returns tool_calls: %s\n", agent.Folder, agent.redactor.String(fmt.Sprint(tool_calls)))
 
 		msg := Anthropic_completion_msg{Role: "assistant", Content: out.Content}
 		agent.Anthropic_props.Messages = append(agent.Anthropic_props.Messages, msg)
 
-		agent.callTools(tool_calls)
-		return len(tool_calls) > 0
+		agent.callTools(ctx, tool_calls)
+		return len(tool_calls) > 0, nil
 
 	} else {
 		startTime := float64(time.Now().UnixMilli()) / 1000
 
-		out, err := OpenAI_completion_Run(agent.OpenAI_props, service.OpenAI_completion_url, service.Api_key)
+		props := agent.OpenAI_props.AdaptToModel(caps)
+		err := _agent_checkContext(props, agent.Model, caps)
 		if err != nil {
-			log.Fatal(err)
+			agent.addLLMCall(callStart, AgentUsage{}, err)
+			return false, err
+		}
+
+		var out OpenAIOut
+		err = Completion_retry(ctx, service, func() error {
+			if streamed {
+				fmt.Println(stream.Flush())
+				streamed = false
+			}
+			var err error
+			out, err = OpenAI_completion_Run(ctx, props, service.OpenAI_completion_url, service.Api_key, fnStreaming)
+			return err
+		})
+		usage := AgentUsage{Input_tokens: out.Usage.Prompt_tokens, Output_tokens: out.Usage.Completion_tokens}
+		if out.Usage.Prompt_tokens_details != nil {
+			usage.Cache_read_tokens = out.Usage.Prompt_tokens_details.Cached_tokens
+			usage.Input_tokens -= usage.Cache_read_tokens
+		}
+		agent.addLLMCall(callStart, usage, err)
+		if err != nil {
+			return false, err
+		}
+		if streamed {
+			fmt.Println(stream.Flush())
 		}
 
 		dt := (float64(time.Now().UnixMilli()) / 1000) - startTime
@@ -338,8 +656,8 @@ func (agent *Agent) Run() bool {
 		}
 
 		fmt.Printf("+LLM(%s) generated %dtoks which took %.1fsec = %.1f toks/sec\n", agent.Folder, out.Usage.Completion_tokens, dt, float64(out.Usage.Completion_tokens)/dt)
-		fmt.Printf("+LLM(%s) returns content: %s\n", agent.Folder, content)
-		fmt.Printf("+LLM(%s) returns tool_calls: %v\n", agent.Folder, tool_calls)
+		fmt.Printf("+LLM(%s) returns content: %s\n", agent.Folder, agent.redactor.String(content))
+		fmt.Printf("+LLM(%s) returns tool_calls: %s\n", agent.Folder, agent.redactor.String(fmt.Sprint(tool_calls)))
 
 		msg := OpenAI_completion_msgCalls{Role: "assistant"}
 		{
@@ -355,13 +673,13 @@ func (agent *Agent) Run() bool {
 		msg.Tool_calls = tool_calls
 		agent.OpenAI_props.Messages = append(agent.OpenAI_props.Messages, msg)
 
-		agent.callTools(tool_calls)
-		return len(tool_calls) > 0
+		agent.callTools(ctx, tool_calls)
+		return len(tool_calls) > 0, nil
 	}
 	//return false
 }
 
-func (agent *Agent) RunLoop(max_iters int, max_tokens int) {
+func (agent *Agent) RunLoop(ctx context.Context, max_iters int, max_tokens int) (AgentResult, error) {
 	orig_max_iters := max_iters
 	orig_max_tokens := max_tokens
 
@@ -373,167 +691,511 @@ func (agent *Agent) RunLoop(max_iters int, max_tokens int) {
 	}
 
 	for max_iters > 0 {
-		if !agent.Run() {
-			return
+		if ctx.Err() != nil {
+			return agent.getResult(_agentStopFromContext(ctx)), ctx.Err()
+		}
+		if reason := agent.budget.Exceeded(); reason != "" {
+			fmt.Printf("Warning: Agent(%s) reached budget(%s)\n", agent.Folder, reason)
+			return agent.getResult(AgentStop_budget), nil
+		}
+
+		called, err := agent.Run(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return agent.getResult(_agentStopFromContext(ctx)), ctx.Err()
+			}
+			return agent.getResult(AgentStop_provider_error), err
 		}
+		if !called {
+			return agent.getResult(AgentStop_finished), nil
+		}
+		agent.warnBudget()
 
 		if agent.TotalTokens >= max_tokens {
 			fmt.Printf("Warning: Agent reached max tokens(%d)\n", orig_max_tokens)
-			return
+			return agent.getResult(AgentStop_max_tokens), nil
 		}
 
 		max_iters--
 	}
 
 	fmt.Printf("Warning: Agent reached max iters(%d)\n", orig_max_iters)
+	return agent.getResult(AgentStop_max_iters), nil
 }
 
-func (agent *Agent) callTools(tool_calls []OpenAI_completion_msg_Content_ToolCall) {
-	if len(agent.Anthropic_props.Messages) > 0 {
-		for _, it := range tool_calls {
-			for _, tool := range agent.Anthropic_props.Tools {
-				if tool.Name == it.Function.Name {
+// Tells model once, that budget is almost used, so it can finish the task before it's stopped.
+func (agent *Agent) warnBudget() {
+	if agent.budget_warned {
+		return
+	}
+	status := agent.budget.NearlyExhausted()
+	if status == "" {
+		return
+	}
+	agent.budget_warned = true
 
-					//call
-					answerJs := agent.callTool(it.Function.Name, it.Function.Arguments)
+	text := fmt.Sprintf("Budget is nearly exhausted(%s). Finish the task now with what you have and call tools only when it's necessary.", status)
+	fmt.Printf("Warning: Agent(%s): %s\n", agent.Folder, text)
 
-					//save answer
-					msg := Anthropic_completion_msg{Role: "user"}
-					msg.AddToolResult(it.Id, answerJs)
-					//msg.AddImage()
-					agent.Anthropic_props.Messages = append(agent.Anthropic_props.Messages, msg)
+	if agent.IsModelAnthropic() {
+		msgs := agent.Anthropic_props.Messages
+		if len(msgs) > 0 && msgs[len(msgs)-1].Role == "user" {
+			msgs[len(msgs)-1].AddText(text) //after tool results, roles must alternate
+		} else {
+			msg := Anthropic_completion_msg{Role: "user"}
+			msg.AddText(text)
+			agent.Anthropic_props.Messages = append(agent.Anthropic_props.Messages, msg)
+		}
+	} else {
+		msg := OpenAI_completion_msg{Role: "user"}
+		msg.AddText(text)
+		agent.OpenAI_props.Messages = append(agent.OpenAI_props.Messages, msg)
+	}
+}
 
-					fmt.Println("+Tool returns:", msg)
-				}
-			}
+func _agentStopFromContext(ctx context.Context) string {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return AgentStop_deadline
+	}
+	return AgentStop_cancelled
+}
+
+func (agent *Agent) getResult(stop_reason string) AgentResult {
+	return AgentResult{
+		Stop_reason:   stop_reason,
+		Final_message: agent.GetFinalMessage(),
+		InputTokens:   agent.InputTokens,
+		OutputTokens:  agent.OutputTokens,
+		TotalTokens:   agent.TotalTokens,
+	}
+}
+
+func (agent *Agent) callTools(ctx context.Context, tool_calls []OpenAI_completion_msg_Content_ToolCall) {
+	//call
+	answers := make([]string, len(tool_calls))
+	found := make([]bool, len(tool_calls))
+	var wg sync.WaitGroup
+	for i, it := range tool_calls {
+		found[i] = agent.hasTool(it.Function.Name)
+		if !found[i] {
+			continue
 		}
-	} else if len(agent.OpenAI_props.Messages) > 0 {
-		for _, it := range tool_calls {
-			for _, tool := range agent.OpenAI_props.Tools {
-				if tool.Function.Name == it.Function.Name {
 
-					//call
-					answerJs := agent.callTool(it.Function.Name, it.Function.Arguments)
+		if agent.parallel_tools {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				answers[i] = agent.callTool(ctx, it.Function.Name, it.Function.Arguments)
+			}()
+		} else {
+			answers[i] = agent.callTool(ctx, it.Function.Name, it.Function.Arguments)
+		}
+	}
+	wg.Wait()
 
-					//save answer
-					msg := OpenAI_completion_msgResult{Role: "tool"}
-					msg.Name = tool.Function.Name
-					msg.Tool_call_id = it.Id
-					msg.Content = string(answerJs)
-					//msg.AddText(string(js))
-					//msg.AddImage()
-					agent.OpenAI_props.Messages = append(agent.OpenAI_props.Messages, msg)
+	//save answers in the original order
+	for i, it := range tool_calls {
+		if !found[i] {
+			continue
+		}
 
-					fmt.Println("+Tool returns:", msg)
-				}
-			}
+		if len(agent.Anthropic_props.Messages) > 0 {
+			msg := Anthropic_completion_msg{Role: "user"}
+			msg.AddToolResult(it.Id, answers[i])
+			//msg.AddImage()
+			agent.Anthropic_props.Messages = append(agent.Anthropic_props.Messages, msg)
+
+			fmt.Println("+Tool returns:", msg)
+
+		} else if len(agent.OpenAI_props.Messages) > 0 {
+			msg := OpenAI_completion_msgResult{Role: "tool"}
+			msg.Name = it.Function.Name
+			msg.Tool_call_id = it.Id
+			msg.Content = answers[i]
+			//msg.AddText(string(js))
+			//msg.AddImage()
+			agent.OpenAI_props.Messages = append(agent.OpenAI_props.Messages, msg)
+
+			fmt.Println("+Tool returns:", msg)
 		}
 	}
 }
 
-func (agent *Agent) callTool(toolName string, arguments string) string {
+func (agent *Agent) hasTool(toolName string) bool {
+	agent.lock.Lock()
+	defer agent.lock.Unlock()
+
+	for _, tool := range agent.Anthropic_props.Tools {
+		if tool.Name == toolName {
+			return true
+		}
+	}
+	for _, tool := range agent.OpenAI_props.Tools {
+		if tool.Function.Name == toolName {
+			return true
+		}
+	}
+	return false
+}
+
+func (agent *Agent) callTool(ctx context.Context, toolName string, arguments string) string {
+	startTime := time.Now()
+
+	//tool's prints are kept, so they don't mix with agent's output
+	stdout := NewToolOutput(64 * 1024)
+	stderr := NewToolOutput(64 * 1024)
+
+	var answer string
+	if err := agent.budget.AddToolCall(); err != nil {
+		answer = fmt.Sprintf("Tool '%s' was not called, because %v. Finish the task with what you have.", toolName, err)
+	} else if agent.approveToolCall(ctx, toolName, arguments) {
+		answer = agent.runTool(ctx, toolName, arguments, stdout, stderr)
+	} else {
+		answer = fmt.Sprintf("Tool '%s' call was denied by operator. Don't try it again with the same arguments.", toolName)
+	}
+	answer = agent.redactor.String(answer) //tool could return password, which must not go to LLM
+
+	agent.lock.Lock()
+	agent.Tool_calls = append(agent.Tool_calls, AgentToolCall{
+		Tool:       toolName,
+		Arguments:  arguments,
+		Result:     answer,
+		Stdout:     agent.redactor.String(stdout.String()),
+		Stderr:     agent.redactor.String(stderr.String()),
+		Start_time: startTime.Unix(),
+		Duration:   time.Since(startTime).Seconds(),
+	})
+	agent.lock.Unlock()
+
+	return answer
+}
+
+func (agent *Agent) approveToolCall(ctx context.Context, toolName string, arguments string) bool {
+	if agent.approval == nil {
+		return true
+	}
+
+	tool := filepath.Join(agent.Folder, toolName)
+	meta, err := LoadToolMeta(tool)
+	if err != nil {
+		fmt.Println("Warning:", err)
+		meta.Risk = Tool_risk_high
+	}
+	return agent.approval.CheckToolCall(ctx, tool, meta.Risk, arguments)
+}
+
+func (agent *Agent) runTool(ctx context.Context, toolName string, arguments string, stdout *ToolOutput, stderr *ToolOutput) string {
 	tool := filepath.Join(agent.Folder, toolName)
 
+	meta, err := LoadToolMeta(tool)
+	if err != nil {
+		return fmt.Sprintf("Tool '%s' can't be started: %v", tool, err)
+	}
+	limits := agent.tool_limits.Merge(meta.Limits)
+
+	fs_policy, err := agent.sandbox_policy.GetFs(tool)
+	if err != nil {
+		return fmt.Sprintf("Tool '%s' can't be started: %v", tool, err)
+	}
+	net_policy := agent.sandbox_policy.GetNet(tool)
+
+	//tool binary is killed when ctx is cancelled or timeout is reached
+	callCtx, cancel := context.WithCancel(ctx)
+	if limits.Wall_sec > 0 {
+		callCtx, cancel = context.WithTimeout(ctx, limits.GetWallTime())
+	}
+	defer cancel()
+
+	//tool sends token after it connects, so server knows which connection belongs to which process
+	call, err := agent.server.NewCall()
+	if err != nil {
+		return fmt.Sprintf("Tool '%s' can't be started: %v", tool, err)
+	}
+	defer agent.server.CloseCall(call)
+
 	//call
 	binPath := filepath.Join(tool, "bin")
-	cmd := exec.Command("./"+binPath, strconv.Itoa(agent.server.port))
+	cmd := exec.CommandContext(callCtx, "./"+binPath, agent.server.GetAddr())
+	cmd.Env = NewToolEnv(call.Token)
 	cmd.Dir = ""
-	cmd.Stdin = os.Stdin //remove later ....
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Start()
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.WaitDelay = time.Second //don't wait for output of tool's children
+	if agent.isolate_tools && ToolIsolation_available() {
+		iso, err := NewToolIsolation(cmd, fs_policy, net_policy, agent.server.GetAddr())
+		if err != nil {
+			return fmt.Sprintf("Tool '%s' can't be isolated: %v", tool, err)
+		}
+		defer iso.Destroy()
+	}
+	los := NewToolLimitsOS(cmd, limits) //wraps isolation init
+	defer los.Destroy()
+	err = cmd.Start()
 	if err != nil {
-		fmt.Println("Error:", err)
+		return fmt.Sprintf("Tool '%s' can't be started: %v", tool, err)
 	}
 
-	cl, err := agent.server.Accept()
-	if err != nil {
-		fmt.Println("Error:", err)
+	//stop waiting for connection when tool exits before it connects
+	exited := make(chan error, 1)
+	acceptCtx, acceptCancel := context.WithCancel(callCtx)
+	go func() {
+		exited <- cmd.Wait()
+		acceptCancel()
+	}()
+
+	cl, err := agent.server.Accept(acceptCtx, call)
+	acceptCancel()
+	if err != nil || cl == nil {
+		cancel() //kill
+		return agent.toolExitMessage(ctx, callCtx, tool, <-exited, nil, stderr, limits, los)
 	}
-	err = cl.WriteArray([]byte(arguments))
+	defer cl.Destroy()
+
+	err = cl.WriteFrame(Protocol_type_input, 0, Protocol_input{Arguments: arguments, Fs_policy: fs_policy, Net_policy: net_policy})
 	if err != nil {
 		fmt.Println("Error:", err)
 	}
 
+	cl.max_payload = uint64(limits.Max_result_bytes)
+
 	var js []byte
-	var tp uint64
-	for tp != 1 {
-		tp, err = cl.ReadInt()
+	for js == nil {
+		frame, err := cl.ReadFrame()
 		if err != nil {
+			if errors.Is(err, Protocol_ErrPayloadLimit) {
+				cancel() //kill, rest of the frame is not read
+				<-exited
+				return fmt.Sprintf("Tool '%s' was killed, because its result is too big: %v", tool, err)
+			}
 			break
 		}
 
-		switch tp {
-		case 1: //result
-			js, _ = cl.ReadArray()
+		switch frame.Type {
+		case Protocol_type_result:
+			var result Protocol_result
+			err = frame.Decode(Protocol_type_result, &result)
+			if err != nil {
+				js = []byte(fmt.Sprintf("Tool '%s' returned invalid result: %v", tool, err))
+				break
+			}
+			js = result.Result
+			if js == nil {
+				js = []byte{}
+			}
 
-		case 2: //SDK_RunAgent
-			max_iters, _ := cl.ReadInt()
-			max_tokens, _ := cl.ReadInt()
-			use_cases, _ := cl.ReadArray()
-			systemPrompt, _ := cl.ReadArray()
-			userPrompt, _ := cl.ReadArray()
+		case Protocol_type_run_agent:
+			var req Protocol_runAgent
+			err = frame.Decode(Protocol_type_run_agent, &req)
+			if err != nil {
+				cl.WriteError(frame.Request_id, err)
+				break
+			}
+
+			if limits.Max_agent_depth > 0 && agent.depth+1 > limits.Max_agent_depth {
+				cl.WriteError(frame.Request_id, fmt.Errorf("sub-agent can't be created, because max depth of nested agents(%d) was reached", limits.Max_agent_depth))
+				break
+			}
 
 			//init
-			agent2 := NewAgent(tool, string(use_cases), string(systemPrompt), string(userPrompt), agent.server, agent.passwords)
+			agent2, err := NewAgent(tool, req.Use_case, req.System_prompt, req.User_prompt, agent.server, agent.passwords)
+			if err != nil {
+				cl.WriteError(frame.Request_id, fmt.Errorf("sub-agent can't be created: %w", err))
+				break
+			}
 			defer agent2.Save(false)
 
 			//run
-			agent2.RunLoop(int(max_iters), int(max_tokens))
+			agent2.tool_limits = agent.tool_limits
+			agent2.depth = agent.depth + 1
+			agent2.parallel_tools = agent.parallel_tools
+			agent2.sandbox_policy = agent.sandbox_policy
+			agent2.isolate_tools = agent.isolate_tools
+			agent2.approval = agent.approval
+			agent2.confirm_secrets = agent.confirm_secrets
+			agent2.redactor = agent.redactor
+			agent2.budget = agent.budget
+			res, err := agent2.RunLoop(callCtx, req.Max_iters, req.Max_tokens)
+			if err == nil && res.Stop_reason == AgentStop_budget {
+				err = fmt.Errorf("budget was used(%s)", agent.budget.Exceeded())
+			}
 
 			//send result back
-			cl.WriteArray([]byte(agent2.GetFinalMessage()))
+			if err != nil {
+				cl.WriteError(frame.Request_id, fmt.Errorf("sub-agent stopped(%s): %w", res.Stop_reason, err))
+			} else {
+				cl.WriteReply(frame.Request_id, Protocol_runAgent_reply{Answer: res.Final_message})
+			}
 			agent2.PrintStats()
 
-		case 3: //SDK_SetToolCode
-			toolName, _ := cl.ReadArray()
-			toolCode, _ := cl.ReadArray()
+			ledger := agent2.getLedger(tool)
+			agent.lock.Lock()
+			agent.Sub_agents = append(agent.Sub_agents, ledger)
+			agent.lock.Unlock()
 
-			path := filepath.Join(tool, string(toolName))
+		case Protocol_type_set_tool_code:
+			var req Protocol_setToolCode
+			err = frame.Decode(Protocol_type_set_tool_code, &req)
+			if err != nil {
+				cl.WriteError(frame.Request_id, err)
+				break
+			}
+
+			path, err := _agent_toolCodePath(tool, req.Tool_name)
+			if err != nil {
+				cl.WriteError(frame.Request_id, err)
+				break
+			}
 			os.MkdirAll(path, os.ModePerm)
-			err := os.WriteFile(filepath.Join(path, "tool.go"), toolCode, 0644)
+
+			//code was written by LLM, operator must review the risk again
+			if meta, err := LoadToolMeta(path); err == nil && meta.Risk != "" && meta.Risk != Tool_risk_high {
+				meta.Risk = ""
+				SaveToolMeta(path, meta)
+			}
+
+			err = os.WriteFile(filepath.Join(path, "tool.go"), []byte(req.Code), 0644)
 			if err != nil {
-				fmt.Println(err)
+				cl.WriteError(frame.Request_id, err)
+				break
 			}
 
+			//'always allow' answers were given to the old code
+			if agent.approval != nil {
+				err = agent.approval.RemoveAllowRules(path)
+				if err != nil {
+					fmt.Println("Warning: approvals of tool can't be removed:", err)
+				}
+			}
+			agent.passwords.RemoveApproved(path)
+
 			err = CompileTool(path)
 			if err == nil {
 				//ok
-				cl.WriteArray(nil)
+				cl.WriteReply(frame.Request_id, Protocol_setToolCode_reply{})
 			} else {
 				//error
-				cl.WriteArray([]byte(fmt.Sprintf("Tool '%s' was created, but compiler reported error: %v", path, err)))
+				cl.WriteError(frame.Request_id, fmt.Errorf("Tool '%s' was created, but compiler reported error: %v", path, err))
 			}
 
-			if agent != nil {
-				agent.AddTool(path)
+			err = agent.AddTool(path)
+			if err != nil {
+				fmt.Println(err)
 			}
 
-		case 4: //SDK_Sandbox_violation
-			info, _ := cl.ReadArray()
-			if agent != nil {
-				agent.Sandbox_violations = append(agent.Sandbox_violations, string(info))
-				fmt.Println("Sandbox violation:", string(info))
+		case Protocol_type_sandbox_violation:
+			var req Protocol_sandboxViolation
+			err = frame.Decode(Protocol_type_sandbox_violation, &req)
+			if err != nil {
+				cl.WriteError(frame.Request_id, err)
+				break
 			}
-			cl.WriteInt(1) //block it
 
-		case 5: //SDK_GetPassword
-			id, _ := cl.ReadArray()
 			if agent != nil {
-				password := agent.passwords.Find(string(id))
-				cl.WriteArray([]byte(password))
-				fmt.Println("Search for password:", string(id))
+				info := agent.redactor.String(req.Info)
+				agent.lock.Lock()
+				agent.Sandbox_violations = append(agent.Sandbox_violations, info)
+				agent.lock.Unlock()
+				fmt.Println("Sandbox violation:", info)
 			}
-			cl.WriteInt(1) //block it
+			block := agent.approval == nil || !agent.approval.CheckSandboxViolation(callCtx, tool, req.Info)
+			cl.WriteReply(frame.Request_id, Protocol_sandboxViolation_reply{Block: block})
 
+		case Protocol_type_get_password:
+			var req Protocol_getPassword
+			err = frame.Decode(Protocol_type_get_password, &req)
+			if err != nil {
+				cl.WriteError(frame.Request_id, err)
+				break
+			}
+
+			password, err := agent.getPassword(callCtx, tool, req.Id, net_policy)
+			if err != nil {
+				cl.WriteError(frame.Request_id, err)
+				break
+			}
+			cl.WriteReply(frame.Request_id, Protocol_getPassword_reply{Password: password})
+
+		default:
+			cl.WriteError(frame.Request_id, fmt.Errorf("unknown frame type %d", frame.Type))
 		}
 	}
 
-	err = cmd.Wait()
+	return agent.toolExitMessage(ctx, callCtx, tool, <-exited, js, stderr, limits, los)
+}
+
+// Tool_name comes from tool, so it must not point outside of folder or into folder, which is not a tool.
+func _agent_toolCodePath(folder string, name string) (string, error) {
+	if !token.IsIdentifier(name) { //also name of tool's structure
+		return "", fmt.Errorf("invalid tool name '%s'", name)
+	}
+
+	path := filepath.Join(folder, name)
+	if info, err := os.Stat(path); err == nil {
+		if !info.IsDir() {
+			return "", fmt.Errorf("'%s' is not a tool folder", path)
+		}
+		if _, err := os.Stat(filepath.Join(path, "tool.go")); err != nil {
+			return "", fmt.Errorf("'%s' is not a tool folder", path)
+		}
+	}
+	return path, nil
+}
+
+// Checks password's scopes and operator's confirmation. Every access is saved into Secret_accesses.
+func (agent *Agent) getPassword(ctx context.Context, tool string, id string, net_policy Protocol_netPolicy) (string, error) {
+	secret, err := agent.passwords.Find(id)
+	if err == nil {
+		err = secret.CheckAccess(tool, net_policy)
+		if err != nil {
+			err = fmt.Errorf("password_id '%s' can't be used by tool '%s': %w", id, tool, err)
+		}
+	}
+	if err == nil && agent.confirm_secrets && !agent.passwords.IsApproved(tool, id) {
+		if agent.approval == nil || !agent.approval.CheckSecretAccess(ctx, tool, id) {
+			err = fmt.Errorf("password_id '%s' was denied for tool '%s' by operator", id, tool)
+		} else {
+			agent.passwords.SetApproved(tool, id)
+		}
+	}
+
+	access := AgentSecretAccess{Tool: tool, Id: id, Time: time.Now().Unix(), Allowed: err == nil}
+	if err != nil {
+		access.Reason = err.Error()
+		fmt.Println("Password access denied:", err)
+	} else {
+		fmt.Printf("Password '%s' was given to tool '%s'\n", id, tool)
+	}
+	agent.lock.Lock()
+	agent.Secret_accesses = append(agent.Secret_accesses, access)
+	agent.lock.Unlock()
+
 	if err != nil {
+		return "", err
+	}
+	return secret.Password, nil
+}
+
+// Converts tool's exit into tool result. End of stderr(log.Fatal message, panic stack) is added, so LLM can fix the tool.
+func (agent *Agent) toolExitMessage(ctx context.Context, callCtx context.Context, tool string, exitErr error, js []byte, stderr *ToolOutput, limits ToolLimits, los *ToolLimitsOS) string {
+	if ctx.Err() != nil {
+		return fmt.Sprintf("Tool '%s' was cancelled", tool)
+	}
+
+	var msg string
+	if errors.Is(callCtx.Err(), context.DeadlineExceeded) {
+		msg = fmt.Sprintf("Tool '%s' was killed, because it reached timeout(%v)", tool, limits.GetWallTime())
+	} else if reason := los.GetExitReason(exitErr); reason != "" {
+		msg = fmt.Sprintf("Tool '%s' was killed, because %s", tool, reason)
+	} else if exitErr != nil {
 		//tool crashed
-		js = []byte(fmt.Sprintf("Tool '%s' crashed with log.Fatal: %s", tool, err.Error()))
+		msg = fmt.Sprintf("Tool '%s' crashed with log.Fatal: %s", tool, exitErr.Error())
+	} else {
+		return string(js)
 	}
 
-	return string(js)
+	tail := stderr.Tail(4096)
+	if tail != "" {
+		msg += "\nStderr:\n" + tail
+	}
+	return msg
 }
@@ -0,0 +1,78 @@
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAgentToolCodePath(t *testing.T) {
+	folder := t.TempDir()
+	os.MkdirAll(filepath.Join(folder, "old_tool"), 0755)
+	os.WriteFile(filepath.Join(folder, "old_tool", "tool.go"), []byte("package main\n"), 0644)
+	os.MkdirAll(filepath.Join(folder, "data"), 0755)
+
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"new_tool", true},
+		{"old_tool", true},
+		{"", false},
+		{"..", false},
+		{"../other_tool", false},
+		{"old_tool/../x", false},
+		{"/etc", false},
+		{"data", false}, //not a tool
+	}
+	for _, tt := range tests {
+		path, err := _agent_toolCodePath(folder, tt.name)
+		if tt.ok && (err != nil || path != filepath.Join(folder, tt.name)) {
+			t.Errorf("'%s': %s, %v", tt.name, path, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("'%s' was accepted", tt.name)
+		}
+	}
+}
+
+func TestAgentCanFallback(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{NewCompletion_errorNetwork(errors.New("connection reset")), true},
+		{&Completion_error{Kind: Completion_error_rate_limit}, true},
+		{&Completion_error{Kind: Completion_error_overloaded}, true},
+		{&Completion_error{Kind: Completion_error_server}, true},
+		{fmt.Errorf("call: %w", &Completion_error{Kind: Completion_error_context_length}), true},
+		{&Completion_error{Kind: Completion_error_auth}, false},
+		{&Completion_error{Kind: Completion_error_invalid}, false},
+		{context.Canceled, false},
+		{errors.New("model x not found"), false},
+	}
+	for _, tt := range tests {
+		if got := _agent_canFallback(tt.err); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// One request to LLM, failed requests are here too.
+type AgentLLMCall struct {
+	Model      string
+	Start_time int64   //unix seconds
+	Duration   float64 //seconds
+
+	Input_tokens       int //without cached tokens
+	Cache_write_tokens int
+	Cache_read_tokens  int
+	Output_tokens      int
+	Cost               float64 //USD
+
+	Error string `json:",omitempty"` //next model from Models was used
+}
+
+// Sum of LLM calls.
+type AgentUsage struct {
+	Calls  int
+	Errors int
+
+	Input_tokens       int //without cached tokens
+	Cache_write_tokens int
+	Cache_read_tokens  int
+	Output_tokens      int
+
+	Duration float64 //seconds
+	Cost     float64 //USD
+}
+
+// Usage of agent and its sub-agents. Ledger of sub-agent is added into parent's Sub_agents, so session of the main agent has the whole agent tree.
+type AgentLedger struct {
+	Folder     string
+	Tool       string `json:",omitempty"` //tool which created sub-agent with SDK_RunAgent(), "" = main agent
+	Model      string
+	LLM_calls  []AgentLLMCall
+	Tool_calls []AgentLedgerToolCall
+	Sub_agents []AgentLedger
+}
+
+type AgentLedgerToolCall struct {
+	Tool     string  //path
+	Duration float64 //seconds
+}
+
+// Per tool in report. Usage is from sub-agents, which tool created.
+type AgentLedgerTool struct {
+	Calls    int
+	Duration float64 //seconds
+	Usage    AgentUsage
+}
+
+func (usage *AgentUsage) AddCall(call AgentLLMCall) {
+	usage.Calls++
+	if call.Error != "" {
+		usage.Errors++
+	}
+	usage.Input_tokens += call.Input_tokens
+	usage.Cache_write_tokens += call.Cache_write_tokens
+	usage.Cache_read_tokens += call.Cache_read_tokens
+	usage.Output_tokens += call.Output_tokens
+	usage.Duration += call.Duration
+	usage.Cost += call.Cost
+}
+
+func (usage *AgentUsage) Add(b AgentUsage) {
+	usage.Calls += b.Calls
+	usage.Errors += b.Errors
+	usage.Input_tokens += b.Input_tokens
+	usage.Cache_write_tokens += b.Cache_write_tokens
+	usage.Cache_read_tokens += b.Cache_read_tokens
+	usage.Output_tokens += b.Output_tokens
+	usage.Duration += b.Duration
+	usage.Cost += b.Cost
+}
+
+// Part of input tokens, which were read from cache.
+func (usage AgentUsage) CacheHitRatio() float64 {
+	input := usage.Input_tokens + usage.Cache_write_tokens + usage.Cache_read_tokens
+	if input == 0 {
+		return 0
+	}
+	return float64(usage.Cache_read_tokens) / float64(input)
+}
+
+func (usage AgentUsage) String() string {
+	return fmt.Sprintf("%d calls(%d failed), tokens(in, cache write, cache read, out): %d, %d, %d, %d, cache hit %.1f%%, %.1fsec, $%f",
+		usage.Calls, usage.Errors, usage.Input_tokens, usage.Cache_write_tokens, usage.Cache_read_tokens, usage.Output_tokens, usage.CacheHitRatio()*100, usage.Duration, usage.Cost)
+}
+
+// Usage of agent's own LLM calls.
+func (ledger *AgentLedger) Own() AgentUsage {
+	var usage AgentUsage
+	for _, call := range ledger.LLM_calls {
+		usage.AddCall(call)
+	}
+	return usage
+}
+
+// Usage of agent and all its sub-agents.
+func (ledger *AgentLedger) Total() AgentUsage {
+	usage := ledger.Own()
+	for i := range ledger.Sub_agents {
+		usage.Add(ledger.Sub_agents[i].Total())
+	}
+	return usage
+}
+
+func (ledger *AgentLedger) addPerModel(models map[string]*AgentUsage) {
+	for _, call := range ledger.LLM_calls {
+		usage, found := models[call.Model]
+		if !found {
+			usage = &AgentUsage{}
+			models[call.Model] = usage
+		}
+		usage.AddCall(call)
+	}
+	for i := range ledger.Sub_agents {
+		ledger.Sub_agents[i].addPerModel(models)
+	}
+}
+
+func (ledger *AgentLedger) addPerTool(tools map[string]*AgentLedgerTool) {
+	get := func(tool string) *AgentLedgerTool {
+		t, found := tools[tool]
+		if !found {
+			t = &AgentLedgerTool{}
+			tools[tool] = t
+		}
+		return t
+	}
+
+	for _, call := range ledger.Tool_calls {
+		t := get(call.Tool)
+		t.Calls++
+		t.Duration += call.Duration
+	}
+	for i := range ledger.Sub_agents {
+		sub := &ledger.Sub_agents[i]
+		get(sub.Tool).Usage.Add(sub.Total())
+		sub.addPerTool(tools)
+	}
+}
+
+func (ledger *AgentLedger) printAgents(depth int) {
+	fmt.Printf("%s- %s(%s): %s\n", strings.Repeat("  ", depth), ledger.Folder, ledger.Model, ledger.Own())
+	for i := range ledger.Sub_agents {
+		ledger.Sub_agents[i].printAgents(depth + 1)
+	}
+}
+
+// Prints totals of the whole agent tree per agent, per tool and per model.
+func (ledger *AgentLedger) PrintReport() {
+	fmt.Println("---Usage---")
+	fmt.Println("Total:", ledger.Total())
+
+	fmt.Println("Per agent:")
+	ledger.printAgents(0)
+
+	tools := map[string]*AgentLedgerTool{}
+	ledger.addPerTool(tools)
+	fmt.Println("Per tool:")
+	for _, name := range _agentUsage_sortedKeys(tools) {
+		t := tools[name]
+		fmt.Printf("- %s: %d calls, %.1fsec", name, t.Calls, t.Duration)
+		if t.Usage.Calls > 0 {
+			fmt.Printf(", sub-agents: %s", t.Usage)
+		}
+		fmt.Println()
+	}
+
+	models := map[string]*AgentUsage{}
+	ledger.addPerModel(models)
+	fmt.Println("Per model:")
+	for _, name := range _agentUsage_sortedKeys(models) {
+		fmt.Printf("- %s: %s\n", name, models[name])
+	}
+
+	fmt.Println("--- ---")
+}
+
+func _agentUsage_sortedKeys[T any](m map[string]T) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Returns usage ledger of agent and its sub-agents. tool is the one which created sub-agent.
+func (agent *Agent) getLedger(tool string) AgentLedger {
+	agent.lock.Lock()
+	defer agent.lock.Unlock()
+
+	ledger := AgentLedger{
+		Folder:     agent.Folder,
+		Tool:       tool,
+		Model:      agent.Model,
+		LLM_calls:  append([]AgentLLMCall{}, agent.LLM_calls...),
+		Sub_agents: append([]AgentLedger{}, agent.Sub_agents...),
+	}
+	for _, call := range agent.Tool_calls {
+		ledger.Tool_calls = append(ledger.Tool_calls, AgentLedgerToolCall{Tool: filepath.Join(agent.Folder, call.Tool), Duration: call.Duration})
+	}
+	return ledger
+}
+
+func (agent *Agent) addLLMCall(startTime time.Time, usage AgentUsage, err error) {
+	call := AgentLLMCall{
+		Model:              agent.Model,
+		Start_time:         startTime.Unix(),
+		Duration:           time.Since(startTime).Seconds(),
+		Input_tokens:       usage.Input_tokens,
+		Cache_write_tokens: usage.Cache_write_tokens,
+		Cache_read_tokens:  usage.Cache_read_tokens,
+		Output_tokens:      usage.Output_tokens,
+		Cost:               Service_getCost(agent.Model, usage),
+	}
+	if err != nil {
+		call.Error = err.Error()
+	}
+	agent.LLM_calls = append(agent.LLM_calls, call)
+	agent.budget.AddLLMCall(call)
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func _testUsage_services() []Service {
+	return []Service{
+		{Name: "anthropic", Anthropic_completion_url: "https://api.anthropic.com/v1/messages", Models: []Model{
+			{Name: "claude", Input_price: 3, Output_price: 15},
+		}},
+		{Name: "openai", OpenAI_completion_url: "https://api.openai.com/v1/chat/completions", Models: []Model{
+			{Name: "gpt", Input_price: 2, Output_price: 8},
+			{Name: "gpt-cached", Input_price: 2, Output_price: 8, Cache_write_price: 2.5, Cache_read_price: 0.2},
+		}},
+	}
+}
+
+func _testUsage_equal(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestServiceGetCost(t *testing.T) {
+	services := g_services
+	defer func() { g_services = services }()
+	g_services = _testUsage_services()
+
+	usage := AgentUsage{Input_tokens: 1000000, Cache_write_tokens: 2000000, Cache_read_tokens: 4000000, Output_tokens: 500000}
+	tests := []struct {
+		model string
+		want  float64
+	}{
+		{"claude", 3 + 2*3.75 + 4*0.3 + 0.5*15},   //write 1.25x, read 0.1x
+		{"gpt", 2 + 2*2 + 4*1 + 0.5*8},            //write 1x, read 0.5x
+		{"gpt-cached", 2 + 2*2.5 + 4*0.2 + 0.5*8}, //prices from models.json
+		{"unknown", 0},
+	}
+	for _, tt := range tests {
+		if got := Service_getCost(tt.model, usage); !_testUsage_equal(got, tt.want) {
+			t.Errorf("%s: got $%f, want $%f", tt.model, got, tt.want)
+		}
+	}
+
+	if got := Service_getCost("claude", AgentUsage{Input_tokens: 1200, Output_tokens: 300}); !_testUsage_equal(got, 0.0081) {
+		t.Errorf("small call: got $%f", got)
+	}
+}
+
+func TestAgentAddLLMCall(t *testing.T) {
+	services := g_services
+	defer func() { g_services = services }()
+	g_services = _testUsage_services()
+
+	agent := &Agent{Model: "claude", budget: NewBudget(0, 0, 10, 0)}
+	agent.addLLMCall(time.Now(), AgentUsage{Input_tokens: 1000, Cache_read_tokens: 10000, Output_tokens: 200}, nil)
+	agent.addLLMCall(time.Now(), AgentUsage{}, errors.New("overloaded"))
+
+	if len(agent.LLM_calls) != 2 {
+		t.Fatalf("got %d calls", len(agent.LLM_calls))
+	}
+	call := agent.LLM_calls[0]
+	if call.Model != "claude" || call.Input_tokens != 1000 || call.Cache_read_tokens != 10000 || call.Output_tokens != 200 || call.Error != "" {
+		t.Errorf("call: %+v", call)
+	}
+	if !_testUsage_equal(call.Cost, (1000*3+10000*0.3+200*15)/1000000.0) {
+		t.Errorf("cost: $%f", call.Cost)
+	}
+	if failed := agent.LLM_calls[1]; failed.Error != "overloaded" || failed.Cost != 0 {
+		t.Errorf("failed call: %+v", failed)
+	}
+	if agent.budget.llm_calls != 2 || agent.budget.tokens != 11200 {
+		t.Errorf("budget: %s", agent.budget)
+	}
+}
+
+func TestAgentLedger(t *testing.T) {
+	sub := AgentLedger{
+		Folder: "tools/web_search",
+		Tool:   "tools/web_search",
+		Model:  "gpt",
+		LLM_calls: []AgentLLMCall{
+			{Model: "gpt", Input_tokens: 100, Cache_read_tokens: 300, Output_tokens: 10, Duration: 1, Cost: 0.5},
+			{Model: "claude", Duration: 0.5, Error: "overloaded"},
+		},
+	}
+	root := AgentLedger{
+		Folder: "tools",
+		Model:  "claude",
+		LLM_calls: []AgentLLMCall{
+			{Model: "claude", Input_tokens: 1000, Cache_write_tokens: 500, Output_tokens: 100, Duration: 2, Cost: 1},
+			{Model: "claude", Input_tokens: 100, Cache_read_tokens: 1400, Output_tokens: 50, Duration: 1, Cost: 0.25},
+		},
+		Tool_calls: []AgentLedgerToolCall{
+			{Tool: "tools/web_search", Duration: 4},
+			{Tool: "tools/web_search", Duration: 1},
+			{Tool: "tools/access_disk", Duration: 0.5},
+		},
+		Sub_agents: []AgentLedger{sub},
+	}
+
+	own := root.Own()
+	if own.Calls != 2 || own.Errors != 0 || own.Input_tokens != 1100 || own.Cache_write_tokens != 500 || own.Cache_read_tokens != 1400 || own.Output_tokens != 150 || !_testUsage_equal(own.Cost, 1.25) {
+		t.Errorf("own: %s", own)
+	}
+	if !_testUsage_equal(own.CacheHitRatio(), 1400.0/3000) {
+		t.Errorf("cache hit ratio: %f", own.CacheHitRatio())
+	}
+	if (AgentUsage{}).CacheHitRatio() != 0 {
+		t.Error("cache hit ratio without input")
+	}
+
+	total := root.Total()
+	if total.Calls != 4 || total.Errors != 1 || total.Input_tokens != 1200 || total.Cache_read_tokens != 1700 || total.Output_tokens != 160 || !_testUsage_equal(total.Duration, 4.5) || !_testUsage_equal(total.Cost, 1.75) {
+		t.Errorf("total: %s", total)
+	}
+
+	models := map[string]*AgentUsage{}
+	root.addPerModel(models)
+	if len(models) != 2 || models["claude"].Calls != 3 || models["claude"].Errors != 1 || models["gpt"].Calls != 1 || !_testUsage_equal(models["gpt"].Cost, 0.5) {
+		t.Errorf("per model: claude %v, gpt %v", models["claude"], models["gpt"])
+	}
+
+	tools := map[string]*AgentLedgerTool{}
+	root.addPerTool(tools)
+	search := tools["tools/web_search"]
+	if search == nil || search.Calls != 2 || !_testUsage_equal(search.Duration, 5) || search.Usage.Calls != 2 || !_testUsage_equal(search.Usage.Cost, 0.5) {
+		t.Errorf("per tool: %+v", search)
+	}
+	if disk := tools["tools/access_disk"]; disk == nil || disk.Calls != 1 || disk.Usage.Calls != 0 {
+		t.Errorf("per tool: %+v", disk)
+	}
+}
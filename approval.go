@@ -0,0 +1,333 @@
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ToolMeta.Risk
+const (
+	Tool_risk_low    = "low"    //only reads
+	Tool_risk_medium = "medium" //changes something, which can be undone
+	Tool_risk_high   = "high"   //deletes, sends, spends. Tools without tool.json are high
+)
+
+func _toolRisk_level(risk string) int {
+	switch risk {
+	case Tool_risk_low:
+		return 0
+	case Tool_risk_medium:
+		return 1
+	}
+	return 2 //high or unknown
+}
+
+// ApprovalRequest.Kind
+const (
+	Approval_tool_call         = "tool_call"
+	Approval_sandbox_violation = "sandbox_violation"
+	Approval_secret_access     = "secret_access"
+)
+
+type ApprovalRequest struct {
+	Kind      string
+	Tool      string //tool folder
+	Risk      string
+	Arguments string //tool call arguments, violation info or password_id
+}
+
+type ApprovalDecision struct {
+	Allow    bool
+	Remember bool   //save as rule into approvals.json
+	Pattern  string //rule's pattern for Arguments, "*" = any
+}
+
+// Asks somebody(terminal, UI, ...) if request can be done.
+type Approver interface {
+	Approve(ctx context.Context, req ApprovalRequest) (ApprovalDecision, error)
+}
+
+// Persisted decision. Pattern is glob('*' matches anything, '?' one character) for ApprovalRequest.Arguments.
+type ApprovalRule struct {
+	Kind    string
+	Tool    string
+	Pattern string
+	Allow   bool
+	Created int64 //unix seconds
+}
+
+// Checks rules from approvals.json first, then asks the approver. Tool calls below the risk threshold are allowed without asking.
+type ApprovalGate struct {
+	approver   Approver
+	min_risk   string //tool calls with this or higher risk must be approved
+	rules_path string
+
+	lock  sync.Mutex
+	Rules []ApprovalRule
+}
+
+func NewApprovalGate(approver Approver, min_risk string, rules_path string) (*ApprovalGate, error) {
+	gate := &ApprovalGate{approver: approver, min_risk: min_risk, rules_path: rules_path}
+
+	if rules_path != "" {
+		js, err := os.ReadFile(rules_path)
+		if err == nil {
+			err = json.Unmarshal(js, gate)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", rules_path, err)
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	return gate, nil
+}
+
+func (gate *ApprovalGate) CheckToolCall(ctx context.Context, tool string, risk string, arguments string) bool {
+	if risk == "" {
+		risk = Tool_risk_high
+	}
+	return gate.check(ctx, ApprovalRequest{Kind: Approval_tool_call, Tool: tool, Risk: risk, Arguments: arguments})
+}
+
+func (gate *ApprovalGate) CheckSandboxViolation(ctx context.Context, tool string, info string) bool {
+	return gate.check(ctx, ApprovalRequest{Kind: Approval_sandbox_violation, Tool: tool, Risk: Tool_risk_high, Arguments: info})
+}
+
+func (gate *ApprovalGate) CheckSecretAccess(ctx context.Context, tool string, password_id string) bool {
+	return gate.check(ctx, ApprovalRequest{Kind: Approval_secret_access, Tool: tool, Risk: Tool_risk_high, Arguments: password_id})
+}
+
+func (gate *ApprovalGate) check(ctx context.Context, req ApprovalRequest) bool {
+	if allow, found := gate.findRule(req); found {
+		return allow
+	}
+
+	if req.Kind == Approval_tool_call && _toolRisk_level(req.Risk) < _toolRisk_level(gate.min_risk) {
+		return true
+	}
+
+	dec, err := gate.approver.Approve(ctx, req)
+	if err != nil {
+		fmt.Printf("Warning: approval of %s from '%s' failed: %v\n", req.Kind, req.Tool, err)
+		return false
+	}
+
+	if dec.Remember {
+		if dec.Pattern == "" {
+			dec.Pattern = "*"
+		}
+		err = gate.addRule(ApprovalRule{Kind: req.Kind, Tool: req.Tool, Pattern: dec.Pattern, Allow: dec.Allow, Created: time.Now().Unix()})
+		if err != nil {
+			fmt.Println("Warning: approval can't be saved:", err)
+		}
+	}
+	return dec.Allow
+}
+
+// Deny rules have priority.
+func (gate *ApprovalGate) findRule(req ApprovalRequest) (allow bool, found bool) {
+	gate.lock.Lock()
+	defer gate.lock.Unlock()
+
+	for _, rule := range gate.Rules {
+		if rule.Kind == req.Kind && rule.Tool == req.Tool && _approval_match(rule.Pattern, req.Arguments) {
+			if !rule.Allow {
+				return false, true
+			}
+			found = true
+		}
+	}
+	return found, found
+}
+
+func (gate *ApprovalGate) addRule(rule ApprovalRule) error {
+	gate.lock.Lock()
+	defer gate.lock.Unlock()
+
+	gate.Rules = append(gate.Rules, rule)
+	return gate.save()
+}
+
+// Removes tool's allow rules(all kinds), because they were given to the old code. Deny rules stay.
+func (gate *ApprovalGate) RemoveAllowRules(tool string) error {
+	gate.lock.Lock()
+	defer gate.lock.Unlock()
+
+	n := len(gate.Rules)
+	gate.Rules = slices.DeleteFunc(gate.Rules, func(rule ApprovalRule) bool {
+		return rule.Allow && rule.Tool == tool
+	})
+	if len(gate.Rules) == n {
+		return nil
+	}
+	return gate.save()
+}
+
+func (gate *ApprovalGate) save() error {
+	if gate.rules_path == "" {
+		return nil
+	}
+	js, err := json.MarshalIndent(gate, "", "\t")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(gate.rules_path, js, 0600)
+}
+
+func _approval_match(pattern string, str string) bool {
+	if pattern == "*" {
+		return true
+	}
+	re := "^" + strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(regexp.QuoteMeta(pattern)) + "$"
+	ok, _ := regexp.MatchString("(?s)"+re, str)
+	return ok
+}
+
+// Writes into temporary file and renames it, so file is never half-written.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) //fails after rename
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Same answer for everything, for batch runs(-auto_approve, -deny_all). Sandbox violations are allowed only with Allow_sandbox(-auto_approve_sandbox).
+type AutoApprover struct {
+	Allow         bool
+	Allow_sandbox bool
+}
+
+func (ap *AutoApprover) Approve(ctx context.Context, req ApprovalRequest) (ApprovalDecision, error) {
+	allow := ap.Allow
+	if req.Kind == Approval_sandbox_violation {
+		allow = ap.Allow_sandbox
+	}
+
+	if allow {
+		fmt.Printf("Auto-approved %s from '%s': %s\n", req.Kind, req.Tool, req.Arguments)
+	} else {
+		fmt.Printf("Auto-denied %s from '%s': %s\n", req.Kind, req.Tool, req.Arguments)
+	}
+	return ApprovalDecision{Allow: allow}, nil
+}
+
+// Asks operator on stdin. Questions from parallel tools are asked one by one.
+type TerminalApprover struct {
+	lock      sync.Mutex
+	startRead sync.Once
+	lines     chan string
+}
+
+func NewTerminalApprover() *TerminalApprover {
+	return &TerminalApprover{lines: make(chan string)}
+}
+
+func (ap *TerminalApprover) Approve(ctx context.Context, req ApprovalRequest) (ApprovalDecision, error) {
+	ap.lock.Lock()
+	defer ap.lock.Unlock()
+
+	//stdin is read by one goroutine, so waiting can be cancelled
+	ap.startRead.Do(func() {
+		go func() {
+			rd := bufio.NewReader(os.Stdin)
+			for {
+				ln, err := rd.ReadString('\n')
+				if err != nil {
+					close(ap.lines)
+					return
+				}
+				ap.lines <- strings.TrimSpace(ln)
+			}
+		}()
+	})
+
+	switch req.Kind {
+	case Approval_tool_call:
+		fmt.Printf("\nApproval needed: tool '%s'(risk %s) wants to run with arguments: %s\n", req.Tool, req.Risk, req.Arguments)
+	case Approval_secret_access:
+		fmt.Printf("\nApproval needed: tool '%s' wants to read password_id: %s\n", req.Tool, req.Arguments)
+	default:
+		fmt.Printf("\nApproval needed: tool '%s' wants to do blocked operation: %s\n", req.Tool, req.Arguments)
+	}
+
+	for {
+		fmt.Print("[y] allow once, [a] always allow this exact request, [t] always allow this tool, [n] deny, [d] always deny this tool: ")
+
+		var ln string
+		select {
+		case l, ok := <-ap.lines:
+			if !ok {
+				return ApprovalDecision{}, fmt.Errorf("stdin is closed")
+			}
+			ln = l
+		case <-ctx.Done():
+			fmt.Println()
+			return ApprovalDecision{}, ctx.Err()
+		}
+
+		switch strings.ToLower(ln) {
+		case "y":
+			return ApprovalDecision{Allow: true}, nil
+		case "a":
+			return ApprovalDecision{Allow: true, Remember: true, Pattern: _approval_escape(req.Arguments)}, nil
+		case "t":
+			return ApprovalDecision{Allow: true, Remember: true, Pattern: "*"}, nil
+		case "n":
+			return ApprovalDecision{Allow: false}, nil
+		case "d":
+			return ApprovalDecision{Allow: false, Remember: true, Pattern: "*"}, nil
+		}
+	}
+}
+
+// Pattern which matches only str.
+func _approval_escape(str string) string {
+	if !strings.ContainsAny(str, "*?") {
+		return str
+	}
+	//glob has no escaping, '?' matches the special character itself too
+	return strings.NewReplacer("*", "?", "?", "?").Replace(str)
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestApprovalRemoveAllowRules(t *testing.T) {
+	rules_path := filepath.Join(t.TempDir(), "approvals.json")
+	gate, err := NewApprovalGate(&AutoApprover{Allow: false}, Tool_risk_high, rules_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gate.addRule(ApprovalRule{Kind: Approval_tool_call, Tool: "tools/a", Pattern: "*", Allow: true})
+	gate.addRule(ApprovalRule{Kind: Approval_secret_access, Tool: "tools/a", Pattern: "mail", Allow: true})
+	gate.addRule(ApprovalRule{Kind: Approval_sandbox_violation, Tool: "tools/a", Pattern: "*/etc/*", Allow: false})
+	gate.addRule(ApprovalRule{Kind: Approval_tool_call, Tool: "tools/b", Pattern: "*", Allow: true})
+
+	err = gate.RemoveAllowRules("tools/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//saved file is checked
+	gate, err = NewApprovalGate(&AutoApprover{Allow: false}, Tool_risk_high, rules_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if gate.CheckToolCall(ctx, "tools/a", Tool_risk_high, "{}") || gate.CheckSecretAccess(ctx, "tools/a", "mail") {
+		t.Error("allow rule of changed tool was kept")
+	}
+	if _, found := gate.findRule(ApprovalRequest{Kind: Approval_sandbox_violation, Tool: "tools/a", Arguments: "write /etc/x"}); !found {
+		t.Error("deny rule was removed")
+	}
+	if !gate.CheckToolCall(ctx, "tools/b", Tool_risk_high, "{}") {
+		t.Error("rule of other tool was removed")
+	}
+}
+
+func TestAutoApprover(t *testing.T) {
+	ctx := context.Background()
+	gate, _ := NewApprovalGate(&AutoApprover{Allow: true}, Tool_risk_high, "")
+	if !gate.CheckToolCall(ctx, "tools/a", Tool_risk_high, "{}") || !gate.CheckSecretAccess(ctx, "tools/a", "mail") {
+		t.Error("-auto_approve denied tool call")
+	}
+	if gate.CheckSandboxViolation(ctx, "tools/a", "write /etc/passwd") {
+		t.Error("-auto_approve approved sandbox violation")
+	}
+
+	gate, _ = NewApprovalGate(&AutoApprover{Allow: true, Allow_sandbox: true}, Tool_risk_high, "")
+	if !gate.CheckSandboxViolation(ctx, "tools/a", "write /etc/passwd") {
+		t.Error("-auto_approve_sandbox denied sandbox violation")
+	}
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Model is warned, when any limit is used from this part.
+const Budget_warn_ratio = 0.9
+
+// Limits of the whole agent tree. Main agent creates it and every sub-agent shares it. 0 = no limit.
+type Budget struct {
+	Max_usd        float64
+	Max_tokens     int
+	Max_llm_calls  int
+	Max_tool_calls int
+
+	lock       sync.Mutex //sub-agents and parallel tools use it at the same time
+	usd        float64
+	tokens     int
+	llm_calls  int
+	tool_calls int
+}
+
+// Returns nil, when there is no limit.
+func NewBudget(max_usd float64, max_tokens int, max_llm_calls int, max_tool_calls int) *Budget {
+	if max_usd <= 0 && max_tokens <= 0 && max_llm_calls <= 0 && max_tool_calls <= 0 {
+		return nil
+	}
+	return &Budget{Max_usd: max_usd, Max_tokens: max_tokens, Max_llm_calls: max_llm_calls, Max_tool_calls: max_tool_calls}
+}
+
+func (budget *Budget) AddLLMCall(call AgentLLMCall) {
+	if budget == nil {
+		return
+	}
+	budget.lock.Lock()
+	defer budget.lock.Unlock()
+
+	budget.usd += call.Cost
+	budget.tokens += call.Input_tokens + call.Cache_write_tokens + call.Cache_read_tokens + call.Output_tokens
+	budget.llm_calls++
+}
+
+// Returns error, when limit of tool calls was reached. Otherwise the call is counted.
+func (budget *Budget) AddToolCall() error {
+	if budget == nil {
+		return nil
+	}
+	budget.lock.Lock()
+	defer budget.lock.Unlock()
+
+	if budget.Max_tool_calls > 0 && budget.tool_calls >= budget.Max_tool_calls {
+		return fmt.Errorf("budget of tool calls(%d) was used", budget.Max_tool_calls)
+	}
+	budget.tool_calls++
+	return nil
+}
+
+// Returns which limit was reached, "" = agent can call LLM. Tool calls are not checked, so model can still write the final answer.
+func (budget *Budget) Exceeded() string {
+	if budget == nil {
+		return ""
+	}
+	budget.lock.Lock()
+	defer budget.lock.Unlock()
+
+	return strings.Join(budget.check(1, false), ", ")
+}
+
+// Returns which limits are almost used, "" = none.
+func (budget *Budget) NearlyExhausted() string {
+	if budget == nil {
+		return ""
+	}
+	budget.lock.Lock()
+	defer budget.lock.Unlock()
+
+	return strings.Join(budget.check(Budget_warn_ratio, true), ", ")
+}
+
+func (budget *Budget) check(ratio float64, tools bool) []string {
+	var out []string
+	if budget.Max_usd > 0 && budget.usd >= budget.Max_usd*ratio {
+		out = append(out, fmt.Sprintf("$%.4f of $%.4f", budget.usd, budget.Max_usd))
+	}
+	if budget.Max_tokens > 0 && float64(budget.tokens) >= float64(budget.Max_tokens)*ratio {
+		out = append(out, fmt.Sprintf("%d of %d tokens", budget.tokens, budget.Max_tokens))
+	}
+	if budget.Max_llm_calls > 0 && float64(budget.llm_calls) >= float64(budget.Max_llm_calls)*ratio {
+		out = append(out, fmt.Sprintf("%d of %d LLM calls", budget.llm_calls, budget.Max_llm_calls))
+	}
+	if tools && budget.Max_tool_calls > 0 && float64(budget.tool_calls) >= float64(budget.Max_tool_calls)*ratio {
+		out = append(out, fmt.Sprintf("%d of %d tool calls", budget.tool_calls, budget.Max_tool_calls))
+	}
+	return out
+}
+
+func (budget *Budget) String() string {
+	if budget == nil {
+		return "no limit"
+	}
+	budget.lock.Lock()
+	defer budget.lock.Unlock()
+
+	out := fmt.Sprintf("$%.4f", budget.usd)
+	if budget.Max_usd > 0 {
+		out += fmt.Sprintf(" of $%.4f", budget.Max_usd)
+	}
+	add := func(used int, max int, name string) {
+		out += fmt.Sprintf(", %d", used)
+		if max > 0 {
+			out += fmt.Sprintf(" of %d", max)
+		}
+		out += " " + name
+	}
+	add(budget.tokens, budget.Max_tokens, "tokens")
+	add(budget.llm_calls, budget.Max_llm_calls, "LLM calls")
+	add(budget.tool_calls, budget.Max_tool_calls, "tool calls")
+	return out
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestBudgetNoLimit(t *testing.T) {
+	budget := NewBudget(0, 0, 0, 0)
+	if budget != nil {
+		t.Fatal("budget without limits must be nil")
+	}
+
+	//agent calls it without checking nil
+	budget.AddLLMCall(AgentLLMCall{Cost: 100, Input_tokens: 1000000})
+	if err := budget.AddToolCall(); err != nil {
+		t.Error(err)
+	}
+	if budget.Exceeded() != "" || budget.NearlyExhausted() != "" || budget.String() != "no limit" {
+		t.Error("nil budget has limit")
+	}
+}
+
+func TestBudgetLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		budget *Budget
+		calls  []AgentLLMCall
+		nearly string //must be in NearlyExhausted()
+		exceed string //must be in Exceeded()
+	}{
+		{"usd under", NewBudget(1, 0, 0, 0), []AgentLLMCall{{Cost: 0.5}}, "", ""},
+		{"usd nearly", NewBudget(1, 0, 0, 0), []AgentLLMCall{{Cost: 0.5}, {Cost: 0.45}}, "$0.9500 of $1.0000", ""},
+		{"usd exceeded", NewBudget(1, 0, 0, 0), []AgentLLMCall{{Cost: 0.5}, {Cost: 0.6}}, "$1.1000 of $1.0000", "$1.1000 of $1.0000"},
+		{"tokens count cache", NewBudget(0, 1000, 0, 0), []AgentLLMCall{{Input_tokens: 100, Cache_write_tokens: 200, Cache_read_tokens: 300, Output_tokens: 400}}, "1000 of 1000 tokens", "1000 of 1000 tokens"},
+		{"tokens under", NewBudget(0, 1000, 0, 0), []AgentLLMCall{{Input_tokens: 500}}, "", ""},
+		{"llm calls", NewBudget(0, 0, 2, 0), []AgentLLMCall{{}, {Error: "failed calls count too"}}, "2 of 2 LLM calls", "2 of 2 LLM calls"},
+		{"more limits", NewBudget(1, 100, 0, 0), []AgentLLMCall{{Cost: 2, Output_tokens: 200}}, "$2.0000 of $1.0000, 200 of 100 tokens", "$2.0000 of $1.0000, 200 of 100 tokens"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, call := range tt.calls {
+				tt.budget.AddLLMCall(call)
+			}
+			if got := tt.budget.NearlyExhausted(); !strings.Contains(got, tt.nearly) || (tt.nearly == "") != (got == "") {
+				t.Errorf("NearlyExhausted() = '%s', want '%s'", got, tt.nearly)
+			}
+			if got := tt.budget.Exceeded(); got != tt.exceed {
+				t.Errorf("Exceeded() = '%s', want '%s'", got, tt.exceed)
+			}
+		})
+	}
+}
+
+func TestBudgetToolCalls(t *testing.T) {
+	budget := NewBudget(0, 0, 0, 10)
+	for i := 0; i < 9; i++ {
+		if err := budget.AddToolCall(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := budget.NearlyExhausted(); got != "9 of 10 tool calls" {
+		t.Errorf("NearlyExhausted() = '%s'", got)
+	}
+	if err := budget.AddToolCall(); err != nil {
+		t.Fatal(err)
+	}
+
+	err := budget.AddToolCall()
+	if err == nil || err.Error() != "budget of tool calls(10) was used" {
+		t.Fatalf("expected error, got %v", err)
+	}
+	if budget.Exceeded() != "" {
+		t.Error("tool calls must not stop LLM, model writes the final answer")
+	}
+	if got := budget.String(); got != "$0.0000, 0 tokens, 0 LLM calls, 10 of 10 tool calls" {
+		t.Errorf("String() = '%s'", got)
+	}
+}
+
+// Sub-agents and parallel tools share one budget.
+func TestBudgetParallel(t *testing.T) {
+	budget := NewBudget(0, 0, 0, 50)
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	allowed := 0
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			budget.AddLLMCall(AgentLLMCall{Output_tokens: 1})
+			if budget.AddToolCall() == nil {
+				lock.Lock()
+				allowed++
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != 50 {
+		t.Errorf("%d tool calls were allowed, limit is 50", allowed)
+	}
+	if got := budget.String(); got != "$0.0000, 100 tokens, 100 LLM calls, 50 of 50 tool calls" {
+		t.Errorf("String() = '%s'", got)
+	}
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Converts conversation between OpenAI and Anthropic formats, so agent can fall back to model from other provider in the middle of the run.
+
+// Any OpenAI message. After Agent.Open() messages are map[string]interface{}, so they are re-decoded from JSON.
+type _convert_openAIMsg struct {
+	Role         string                                   `json:"role"`
+	Content      json.RawMessage                          `json:"content"` //string or []OpenAI_completion_msg_Content
+	Tool_calls   []OpenAI_completion_msg_Content_ToolCall `json:"tool_calls"`
+	Tool_call_id string                                   `json:"tool_call_id"`
+}
+
+// Copies System, Messages and Tools. Other props are not changed.
+func Completion_convertToAnthropic(src *OpenAI_completion_props, dst *Anthropic_completion_props) error {
+	dst.System = ""
+	dst.Messages = nil
+	dst.Tools = nil
+
+	for _, it := range src.Messages {
+		js, err := json.Marshal(it)
+		if err != nil {
+			return err
+		}
+		var msg _convert_openAIMsg
+		err = json.Unmarshal(js, &msg)
+		if err != nil {
+			return err
+		}
+
+		var text string
+		var parts []OpenAI_completion_msg_Content
+		if json.Unmarshal(msg.Content, &text) != nil {
+			json.Unmarshal(msg.Content, &parts)
+		}
+
+		switch msg.Role {
+		case "system":
+			if dst.System != "" {
+				dst.System += "\n\n"
+			}
+			dst.System += text
+
+		case "tool":
+			out := Anthropic_completion_msg{Role: "user"}
+			out.AddToolResult(msg.Tool_call_id, text)
+			dst.Messages = append(dst.Messages, out)
+
+		default: //user, assistant
+			out := Anthropic_completion_msg{Role: msg.Role}
+			if text != "" {
+				out.AddText(text)
+			}
+			for _, part := range parts {
+				switch {
+				case part.Type == "text" && part.Text != "":
+					out.AddText(part.Text)
+				case part.Type == "image_url" && part.Image_url != nil:
+					out.Content = append(out.Content, _convert_imageToAnthropic(part.Image_url.Url))
+				}
+			}
+			for _, call := range msg.Tool_calls {
+				input := json.RawMessage(call.Function.Arguments)
+				if !json.Valid(input) {
+					input = json.RawMessage("{}")
+				}
+				out.Content = append(out.Content, Anthropic_completion_msg_Content{Type: "tool_use", Id: call.Id, Name: call.Function.Name, Input: input})
+			}
+			if len(out.Content) > 0 { //Anthropic rejects empty messages
+				dst.Messages = append(dst.Messages, out)
+			}
+		}
+	}
+
+	for _, tool := range src.Tools {
+		dst.Tools = append(dst.Tools, &Anthropic_completion_tool{Name: tool.Function.Name, Description: tool.Function.Description, Input_schema: tool.Function.Parameters})
+	}
+	return nil
+}
+
+// Copies System, Messages and Tools. Other props are not changed.
+func Completion_convertToOpenAI(src *Anthropic_completion_props, dst *OpenAI_completion_props) error {
+	dst.Messages = nil
+	dst.Tools = nil
+
+	if src.System != "" {
+		dst.Messages = append(dst.Messages, OpenAI_completion_msgPlain{Role: "system", Content: src.System})
+	}
+
+	tool_names := map[string]string{} //[tool_use id]name, Mistral wants name in result
+	for _, msg := range src.Messages {
+		switch msg.Role {
+		case "assistant":
+			out := OpenAI_completion_msgCalls{Role: "assistant"}
+			for _, it := range msg.Content {
+				switch it.Type {
+				case "text":
+					out.Content += it.Text
+				case "tool_use":
+					args := string(it.Input)
+					if args == "" {
+						args = "{}"
+					}
+					out.Tool_calls = append(out.Tool_calls, OpenAI_completion_msg_Content_ToolCall{Id: it.Id, Type: "function", Function: OpenAI_completion_msg_Content_ToolCall_Function{Name: it.Name, Arguments: args}})
+					tool_names[it.Id] = it.Name
+				}
+			}
+			dst.Messages = append(dst.Messages, out)
+
+		default: //user
+			//tool results must follow assistant's tool calls
+			out := OpenAI_completion_msg{Role: msg.Role}
+			for _, it := range msg.Content {
+				switch it.Type {
+				case "tool_result":
+					dst.Messages = append(dst.Messages, OpenAI_completion_msgResult{Role: "tool", Content: it.Content, Tool_call_id: it.Tool_use_id, Name: tool_names[it.Tool_use_id]})
+				case "text":
+					out.AddText(it.Text)
+				case "image":
+					if it.Source != nil {
+						out.Content = append(out.Content, OpenAI_completion_msg_Content{Type: "image_url", Image_url: &OpenAI_completion_msg_Content_Image_url{Detail: "high", Url: "data:" + it.Source.Media_type + ";base64," + it.Source.Data}})
+					}
+				}
+			}
+			if len(out.Content) > 0 {
+				dst.Messages = append(dst.Messages, out)
+			}
+		}
+	}
+
+	for _, tool := range src.Tools {
+		dst.Tools = append(dst.Tools, &OpenAI_completion_tool{Type: "function", Function: OpenAI_completion_tool_function{Name: tool.Name, Description: tool.Description, Parameters: tool.Input_schema}})
+	}
+	return nil
+}
+
+// "data:image/png;base64,<data>". Anthropic's image struct has only base64 data, so url is sent as text.
+func _convert_imageToAnthropic(url string) Anthropic_completion_msg_Content {
+	if rest, found := strings.CutPrefix(url, "data:"); found {
+		media_type, data, found := strings.Cut(rest, ";base64,")
+		if found {
+			return Anthropic_completion_msg_Content{Type: "image", Source: &Anthropic_completion_msg_content_Image{Type: "base64", Media_type: media_type, Data: data}}
+		}
+	}
+	return Anthropic_completion_msg_Content{Type: "text", Text: "Image: " + url}
+}
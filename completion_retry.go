@@ -0,0 +1,199 @@
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Completion_error.Kind
+const (
+	Completion_error_network        = "network"
+	Completion_error_rate_limit     = "rate_limit"
+	Completion_error_overloaded     = "overloaded"
+	Completion_error_server         = "server"
+	Completion_error_auth           = "auth"
+	Completion_error_context_length = "context_length"
+	Completion_error_invalid        = "invalid_request"
+)
+
+type Completion_error struct {
+	Kind        string
+	StatusCode  int           //0 = network error
+	Retryable   bool          //false = fatal, don't try again
+	Retry_after time.Duration //0 = not set by provider
+	Message     string
+
+	Err error
+}
+
+func (e *Completion_error) Error() string {
+	if e.StatusCode > 0 {
+		return fmt.Sprintf("%s: statusCode %d, response: %s", e.Kind, e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Kind, e.Message)
+}
+
+func (e *Completion_error) Unwrap() error {
+	return e.Err
+}
+
+func NewCompletion_errorNetwork(err error) *Completion_error {
+	return &Completion_error{Kind: Completion_error_network, Retryable: true, Message: err.Error(), Err: err}
+}
+
+// Classifies non-200 response. body is the raw response(JSON with error message or plain text).
+func NewCompletion_errorFromResponse(res *http.Response, body []byte) *Completion_error {
+	e := &Completion_error{StatusCode: res.StatusCode, Message: string(body)}
+
+	//both OpenAI and Anthropic use {"error": {"message": "..."}}
+	var js struct {
+		Error *struct {
+			Type    string
+			Message string
+		}
+	}
+	if json.Unmarshal(body, &js) == nil && js.Error != nil && js.Error.Message != "" {
+		e.Message = js.Error.Message
+	}
+	msg := strings.ToLower(e.Message)
+
+	switch {
+	case res.StatusCode == 429:
+		e.Kind = Completion_error_rate_limit
+		e.Retryable = true
+	case res.StatusCode == 529 || strings.Contains(msg, "overloaded"):
+		e.Kind = Completion_error_overloaded
+		e.Retryable = true
+	case res.StatusCode == 408 || res.StatusCode == 409 || res.StatusCode >= 500:
+		e.Kind = Completion_error_server
+		e.Retryable = true
+	case res.StatusCode == 401 || res.StatusCode == 403:
+		e.Kind = Completion_error_auth
+	case strings.Contains(msg, "context length") || strings.Contains(msg, "context_length") || strings.Contains(msg, "too long") || strings.Contains(msg, "maximum context"):
+		e.Kind = Completion_error_context_length
+	default:
+		e.Kind = Completion_error_invalid //bad tool schema, unknown model, etc.
+	}
+
+	if e.Retryable {
+		e.Retry_after = _completion_retryAfter(res.Header, res.StatusCode == 429)
+	}
+
+	return e
+}
+
+// Returns how long provider wants us to wait. Checks 'Retry-After' and with rateLimit also OpenAI/Anthropic rate-limit headers.
+// Rate-limit headers are sent with every response and say when the window resets, not when to retry 5xx.
+func _completion_retryAfter(header http.Header, rateLimit bool) time.Duration {
+	var wait time.Duration
+
+	if ms, err := strconv.ParseFloat(header.Get("retry-after-ms"), 64); err == nil {
+		wait = time.Duration(ms * float64(time.Millisecond))
+	} else if v := header.Get("Retry-After"); v != "" {
+		if sec, err := strconv.ParseFloat(v, 64); err == nil {
+			wait = time.Duration(sec * float64(time.Second))
+		} else if tm, err := http.ParseTime(v); err == nil {
+			wait = time.Until(tm)
+		}
+	}
+
+	if !rateLimit {
+		return wait
+	}
+
+	//OpenAI: "1s", "6m0s", "20ms"
+	for _, key := range []string{"x-ratelimit-reset-requests", "x-ratelimit-reset-tokens"} {
+		if dt, err := time.ParseDuration(header.Get(key)); err == nil && dt > wait {
+			wait = dt
+		}
+	}
+
+	//Anthropic: RFC 3339 time stamp
+	for _, key := range []string{"anthropic-ratelimit-requests-reset", "anthropic-ratelimit-tokens-reset"} {
+		if tm, err := time.Parse(time.RFC3339, header.Get(key)); err == nil {
+			if dt := time.Until(tm); dt > wait {
+				wait = dt
+			}
+		}
+	}
+
+	return wait
+}
+
+// Returns pointer for Service.Max_retries.
+func Completion_maxRetries(n int) *int {
+	return &n
+}
+
+// Calls fn() until it succeeds, returns non-retryable error or runs out of service.Max_retries. Delay between tries grows exponentially(with jitter), but provider's Retry-After has priority up to max delay.
+func Completion_retry(ctx context.Context, service *Service, fn func() error) error {
+	max_retries := 5 //default
+	if service.Max_retries != nil {
+		max_retries = *service.Max_retries
+	}
+	min_delay := time.Duration(service.Retry_min_delay * float64(time.Second))
+	if min_delay <= 0 {
+		min_delay = 1 * time.Second
+	}
+	max_delay := time.Duration(service.Retry_max_delay * float64(time.Second))
+	if max_delay <= 0 {
+		max_delay = 60 * time.Second
+	}
+
+	for try := 0; ; try++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err() //cancelled, Do() failed because of it
+		}
+
+		var cerr *Completion_error
+		if !errors.As(err, &cerr) || !cerr.Retryable || try >= max_retries {
+			return err
+		}
+
+		//exponential backoff with full jitter
+		delay := min_delay << try
+		if delay > max_delay || delay <= 0 {
+			delay = max_delay
+		}
+		delay = min_delay + time.Duration(rand.Int63n(int64(delay-min_delay)+1))
+
+		if cerr.Retry_after > delay {
+			delay = min(cerr.Retry_after, max_delay) //reset of daily limit can be hours away
+		}
+
+		fmt.Printf("Warning: service '%s' failed(%v), retry %d/%d in %.1fsec\n", service.Name, err, try+1, max_retries, delay.Seconds())
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCompletionRetryAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		header map[string]string
+		want   time.Duration
+	}{
+		{"retry-after", 503, map[string]string{"Retry-After": "3"}, 3 * time.Second},
+		{"retry-after-ms", 529, map[string]string{"retry-after-ms": "1500"}, 1500 * time.Millisecond},
+		{"reset on 429", 429, map[string]string{"Retry-After": "1", "x-ratelimit-reset-tokens": "6m0s"}, 6 * time.Minute},
+		{"reset on 5xx", 500, map[string]string{"x-ratelimit-reset-requests": "6m0s"}, 0},
+		{"anthropic reset on 5xx", 529, map[string]string{"anthropic-ratelimit-tokens-reset": time.Now().Add(time.Hour).Format(time.RFC3339)}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := &http.Response{StatusCode: tt.status, Header: http.Header{}}
+			for key, value := range tt.header {
+				res.Header.Set(key, value)
+			}
+			e := NewCompletion_errorFromResponse(res, nil)
+			if e.Retry_after != tt.want {
+				t.Fatalf("expected %v, got %v", tt.want, e.Retry_after)
+			}
+		})
+	}
+}
+
+func TestCompletionRetry(t *testing.T) {
+	fail := &Completion_error{Kind: Completion_error_rate_limit, Retryable: true, Retry_after: time.Hour}
+
+	//0 = never retry
+	calls := 0
+	service := &Service{Name: "test", Max_retries: Completion_maxRetries(0)}
+	Completion_retry(context.Background(), service, func() error { calls++; return fail })
+	if calls != 1 {
+		t.Fatalf("expected 1 call, got %d", calls)
+	}
+
+	//Retry_after is clamped to Retry_max_delay
+	calls = 0
+	service = &Service{Name: "test", Max_retries: Completion_maxRetries(1), Retry_min_delay: 0.01, Retry_max_delay: 0.01}
+	start := time.Now()
+	Completion_retry(context.Background(), service, func() error { calls++; return fail })
+	if calls != 2 || time.Since(start) > 10*time.Second {
+		t.Fatalf("expected 2 calls without waiting for Retry_after, got %d in %v", calls, time.Since(start))
+	}
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompletionStreamEnd(t *testing.T) {
+	anthropic := "data: {\"type\":\"message_start\",\"message\":{\"role\":\"assistant\"}}\n\n" +
+		"data: {\"type\":\"content_block_start\",\"index\":0,\"content_block\":{\"type\":\"text\",\"text\":\"\"}}\n\n" +
+		"data: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"Hello\"}}\n\n"
+	openai := "data: {\"choices\":[{\"delta\":{\"content\":\"Hello\"}}]}\n\n"
+
+	tests := []struct {
+		name      string
+		read      func(body io.Reader) error
+		body      string
+		truncated bool
+	}{
+		{"anthropic complete", _testStream_anthropic, anthropic + "data: {\"type\":\"message_stop\"}\n\n", false},
+		{"anthropic truncated", _testStream_anthropic, anthropic, true},
+		{"openai complete", _testStream_openai, openai + "data: [DONE]\n\n", false},
+		{"openai truncated", _testStream_openai, openai, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.read(strings.NewReader(tt.body))
+			if !tt.truncated {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var cerr *Completion_error
+			if !errors.As(err, &cerr) || !cerr.Retryable || cerr.Kind != Completion_error_network || !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("expected retryable network error with io.ErrUnexpectedEOF, got %v", err)
+			}
+		})
+	}
+}
+
+func _testStream_anthropic(body io.Reader) error {
+	_, err := _Anthropic_completion_readStream(body, nil)
+	return err
+}
+
+func _testStream_openai(body io.Reader) error {
+	_, err := _OpenAI_completion_readStream(body, nil)
+	return err
+}
+
+// Every line is one Server-Sent Event.
+func _testStream_sse(events ...string) string {
+	var sb strings.Builder
+	for _, ev := range events {
+		sb.WriteString("data: " + ev + "\n\n")
+	}
+	return sb.String()
+}
+
+func TestOpenAIStream(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		content   string
+		streamed  string
+		toolCalls []OpenAI_completion_msg_Content_ToolCall
+		usage     OpenAIOutUsage
+	}{
+		{
+			name: "text",
+			body: _testStream_sse(
+				`{"choices":[{"delta":{"role":"assistant","content":"Hel"}}]}`,
+				`{"choices":[{"delta":{"content":"lo"}}]}`,
+				`{"choices":[],"usage":{"prompt_tokens":120,"completion_tokens":5,"total_tokens":125,"prompt_tokens_details":{"cached_tokens":100}}}`,
+				`[DONE]`),
+			content:  "Hello",
+			streamed: "Hello",
+			usage:    OpenAIOutUsage{Prompt_tokens: 120, Completion_tokens: 5, Total_tokens: 125, Prompt_tokens_details: &OpenAIOutUsage_PromptDetails{Cached_tokens: 100}},
+		},
+		{
+			name: "tool calls by index",
+			body: _testStream_sse(
+				`{"choices":[{"delta":{"tool_calls":[{"index":0,"id":"call_a","type":"function","function":{"name":"get_weather","arguments":""}}]}}]}`,
+				`{"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"city\":"}}]}}]}`,
+				`{"choices":[{"delta":{"tool_calls":[{"index":1,"id":"call_b","type":"function","function":{"name":"get_time","arguments":"{}"}}]}}]}`,
+				`{"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"Prague\"}"}}]}}]}`,
+				`{"choices":[{"delta":{},"finish_reason":"tool_calls"}]}`,
+				`{"choices":[],"usage":{"prompt_tokens":50,"completion_tokens":20,"total_tokens":70}}`,
+				`[DONE]`),
+			toolCalls: []OpenAI_completion_msg_Content_ToolCall{
+				{Id: "call_a", Type: "function", Function: OpenAI_completion_msg_Content_ToolCall_Function{Name: "get_weather", Arguments: `{"city":"Prague"}`}},
+				{Id: "call_b", Type: "function", Function: OpenAI_completion_msg_Content_ToolCall_Function{Name: "get_time", Arguments: "{}"}},
+			},
+			usage: OpenAIOutUsage{Prompt_tokens: 50, Completion_tokens: 20, Total_tokens: 70},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			streamed := ""
+			out, err := _OpenAI_completion_readStream(strings.NewReader(tt.body), func(chunk string) { streamed += chunk })
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := out.Choices[0].Message
+			if msg.Content != tt.content || streamed != tt.streamed {
+				t.Errorf("content '%s', streamed '%s', want '%s'", msg.Content, streamed, tt.content)
+			}
+			if !reflect.DeepEqual(msg.Tool_calls, tt.toolCalls) {
+				t.Errorf("tool calls %+v, want %+v", msg.Tool_calls, tt.toolCalls)
+			}
+			if !reflect.DeepEqual(out.Usage, tt.usage) {
+				t.Errorf("usage %+v, want %+v", out.Usage, tt.usage)
+			}
+		})
+	}
+}
+
+func TestAnthropicStream(t *testing.T) {
+	start := `{"type":"message_start","message":{"role":"assistant","usage":{"input_tokens":30,"output_tokens":1,"cache_creation_input_tokens":200,"cache_read_input_tokens":1000}}}`
+	usage := AnthropicOut_Usage{Input_tokens: 30, Output_tokens: 42, Cache_creation_input_tokens: 200, Cache_read_input_tokens: 1000}
+
+	tests := []struct {
+		name       string
+		body       string
+		content    []Anthropic_completion_msg_Content
+		streamed   string
+		stopReason string
+	}{
+		{
+			name: "text",
+			body: _testStream_sse(start,
+				`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+				`{"type":"ping"}`,
+				`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hel"}}`,
+				`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"lo"}}`,
+				`{"type":"content_block_stop","index":0}`,
+				`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":42}}`,
+				`{"type":"message_stop"}`),
+			content:    []Anthropic_completion_msg_Content{{Type: "text", Text: "Hello"}},
+			streamed:   "Hello",
+			stopReason: "end_turn",
+		},
+		{
+			name: "tool input",
+			body: _testStream_sse(start,
+				`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+				`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Checking."}}`,
+				`{"type":"content_block_stop","index":0}`,
+				`{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_a","name":"get_weather","input":{}}}`,
+				`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":""}}`,
+				`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"city\": \"Pra"}}`,
+				`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"gue\"}"}}`,
+				`{"type":"content_block_stop","index":1}`,
+				`{"type":"content_block_start","index":2,"content_block":{"type":"tool_use","id":"toolu_b","name":"get_time","input":{}}}`,
+				`{"type":"content_block_stop","index":2}`,
+				`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":42}}`,
+				`{"type":"message_stop"}`),
+			content: []Anthropic_completion_msg_Content{
+				{Type: "text", Text: "Checking."},
+				{Type: "tool_use", Id: "toolu_a", Name: "get_weather", Input: json.RawMessage(`{"city": "Prague"}`)},
+				{Type: "tool_use", Id: "toolu_b", Name: "get_time", Input: json.RawMessage(`{}`)}, //no input_json_delta
+			},
+			streamed:   "Checking.",
+			stopReason: "tool_use",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			streamed := ""
+			out, err := _Anthropic_completion_readStream(strings.NewReader(tt.body), func(chunk string) { streamed += chunk })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(out.Content, tt.content) {
+				t.Errorf("content %+v, want %+v", out.Content, tt.content)
+			}
+			if streamed != tt.streamed || out.Stop_reason != tt.stopReason || out.Role != "assistant" {
+				t.Errorf("streamed '%s', stop_reason '%s', role '%s'", streamed, out.Stop_reason, out.Role)
+			}
+			if out.Usage != usage {
+				t.Errorf("usage %+v, want %+v", out.Usage, usage)
+			}
+		})
+	}
+}
@@ -2,4 +2,10 @@ module sky_agent
 
 go 1.23.5
 
-require github.com/mattn/go-sqlite3 v1.14.24
+require (
+	github.com/mattn/go-sqlite3 v1.14.24
+	golang.org/x/crypto v0.40.0
+	golang.org/x/term v0.33.0
+)
+
+require golang.org/x/sys v0.34.0 // indirect
@@ -17,35 +17,160 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 )
 
 func main() {
+	ToolLimits_runInit()    //when started as tool's limits wrapper, it doesn't return
+	ToolIsolation_runInit() //when started as tool's isolation init, it doesn't return
+
 	log.SetFlags(log.Llongfile) //log.LstdFlags | log.Lshortfile
+
+	if len(os.Args) > 1 && os.Args[1] == "vault" {
+		os.Exit(Passwords_runCommand(os.Args[2:]))
+	}
+
+	max_iters := flag.Int("max_iters", 20, "Maximum number of LLM calls of the main agent. 0 = no limit.")
+	max_tokens := flag.Int("max_tokens", 20000, "Maximum number of tokens of the main agent. 0 = no limit.")
+	budget_usd := flag.Float64("budget_usd", 0, "Maximum price(USD) of LLM calls of the main agent and all sub-agents together. 0 = no limit.")
+	budget_tokens := flag.Int("budget_tokens", 0, "Maximum number of tokens of the main agent and all sub-agents together. 0 = no limit.")
+	budget_llm_calls := flag.Int("budget_llm_calls", 0, "Maximum number of LLM calls of the main agent and all sub-agents together. 0 = no limit.")
+	budget_tool_calls := flag.Int("budget_tool_calls", 0, "Maximum number of tool calls of the main agent and all sub-agents together. 0 = no limit.")
+	deadline := flag.Duration("deadline", 0, "Wall-clock limit for the whole run(for example 10m). 0 = no limit.")
+	var tool_limits ToolLimits
+	flag.Float64Var(&tool_limits.Wall_sec, "tool_timeout", 600, "Tool binary is killed after this time(seconds). 0 = no limit.")
+	flag.IntVar(&tool_limits.Cpu_sec, "tool_cpu_sec", 300, "Tool's CPU time limit(seconds). 0 = no limit. Linux only.")
+	flag.IntVar(&tool_limits.Memory_mb, "tool_memory_mb", 1024, "Tool's memory limit(MB). 0 = no limit. Linux only.")
+	flag.IntVar(&tool_limits.Max_processes, "tool_max_processes", 64, "Tool's process count limit. 0 = no limit. Linux with cgroup v2 only.")
+	flag.IntVar(&tool_limits.Max_result_bytes, "tool_max_result_bytes", 1024*1024, "Tool's result size limit. 0 = no limit.")
+	flag.IntVar(&tool_limits.Max_agent_depth, "max_agent_depth", 5, "How many agents can be nested by SDK_RunAgent(). 0 = no limit.")
+	isolate_tools := flag.Bool("isolate_tools", false, "Run tools in new Linux namespaces(read-only repository, overlays of writable folders like disk/) with seccomp filter. Falls back to normal mode, when namespaces or overlays are not available.")
+	auto_approve := flag.Bool("auto_approve", false, "Approve all risky tool calls and password accesses without asking. Sandbox violations are still denied. For batch runs.")
+	auto_approve_sandbox := flag.Bool("auto_approve_sandbox", false, "With -auto_approve, approve also sandbox violations(writes outside of policy, blocked hosts, ...). Tools can then do anything the user can.")
+	deny_all := flag.Bool("deny_all", false, "Deny all risky tool calls and sandbox violations without asking. For batch runs.")
+	approve_risk := flag.String("approve_risk", Tool_risk_high, "Tool calls with this or higher risk(low, medium, high) must be approved. Risk is set in tool's tool.json, tools without it are high.")
+	confirm_secrets := flag.Bool("confirm_secrets", true, "Operator confirms the first SDK_GetPassword() of every tool and password_id(answers 'a', 't' are saved into approvals.json). Scopes are set by 'sky_agent vault scope'.")
+	models_path := flag.String("models", "models.json", "Services, models, prices and use cases. Built-in defaults are used, when file doesn't exist.")
+	parallel_tools := flag.Bool("parallel_tools", false, "Run tool calls from one LLM answer at the same time.")
+	flag.Parse()
+
 	UserPrompt := "Send email to <email>. Subject: Test. Body: Hello there!"
 
-	if len(os.Args) > 1 {
-		UserPrompt = os.Args[1]
+	if flag.NArg() > 0 {
+		UserPrompt = flag.Arg(0)
+	}
+
+	//Ctrl-C cancels all agents and tools, transcript is still saved. Second Ctrl-C kills the program.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func(sig_ctx context.Context) {
+		<-sig_ctx.Done() //own copy, ctx is replaced by deadline below
+		stop()
+	}(ctx)
+
+	if *deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *deadline)
+		defer cancel()
+	}
+
+	err := LoadModelsConfig(*models_path)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+
+	sandbox_policy, err := LoadSandboxPolicy("sandbox_policy.json")
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
 	}
 
-	passwords := NewPasswords()
+	if _toolRisk_level(*approve_risk) == 2 && *approve_risk != Tool_risk_high {
+		fmt.Printf("Error: invalid -approve_risk '%s'\n", *approve_risk)
+		return
+	}
+	var approver Approver
+	switch {
+	case *auto_approve && *deny_all:
+		fmt.Println("Error: -auto_approve and -deny_all can't be used together")
+		return
+	case *auto_approve_sandbox && !*auto_approve:
+		fmt.Println("Error: -auto_approve_sandbox needs -auto_approve")
+		return
+	case *auto_approve:
+		approver = &AutoApprover{Allow: true, Allow_sandbox: *auto_approve_sandbox}
+	case *deny_all:
+		approver = &AutoApprover{Allow: false}
+	default:
+		approver = NewTerminalApprover()
+	}
+	approval, err := NewApprovalGate(approver, *approve_risk, "approvals.json")
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+
+	passwords, err := NewPasswords("passwords.vault", "passwords.json")
+	if err != nil {
+		fmt.Println("Warning: passwords are not available:", err)
+	}
 	defer passwords.Destroy()
 
-	server := NewNetServer(8090)
+	redact_patterns, err := LoadRedactPatterns("redact_patterns.txt")
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	redactor, err := NewRedactor(passwords, redact_patterns)
+	if err != nil {
+		fmt.Println("Error: redact_patterns.txt:", err)
+		return
+	}
+
+	server := NewNetServer(18090) //TCP fallback, 8090 is used by "local" LLM service
 	defer server.Destroy()
 
-	mainAgent := NewAgent("tools", "agent", "", UserPrompt, server, passwords)
+	mainAgent, err := NewAgent("tools", "agent", "", UserPrompt, server, passwords)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	mainAgent.tool_limits = tool_limits
+	mainAgent.sandbox_policy = sandbox_policy
+	mainAgent.isolate_tools = *isolate_tools
+	mainAgent.approval = approval
+	mainAgent.confirm_secrets = *confirm_secrets
+	mainAgent.redactor = redactor
+	mainAgent.parallel_tools = *parallel_tools
+	mainAgent.budget = NewBudget(*budget_usd, *budget_tokens, *budget_llm_calls, *budget_tool_calls)
 	if strings.ToLower(UserPrompt) == "continue" {
-		mainAgent.Open("last.json") //recover previous state
+		err = mainAgent.Open("last.json") //recover previous state
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
 	}
 	defer mainAgent.Save(true)
 
 	//run
-	mainAgent.RunLoop(20, 20000)
+	res, err := mainAgent.RunLoop(ctx, *max_iters, *max_tokens)
 
 	mainAgent.PrintStats()
-	fmt.Println("Final answer:", mainAgent.GetFinalMessage())
+	ledger := mainAgent.getLedger("")
+	ledger.PrintReport()
+	if mainAgent.budget != nil {
+		fmt.Println("Budget:", mainAgent.budget)
+	}
+	if err != nil {
+		fmt.Printf("Error: Agent stopped(%s): %v\n", res.Stop_reason, err)
+	}
+	fmt.Println("Final answer:", res.Final_message)
 }
@@ -16,14 +16,46 @@ limitations under the License.
 
 package main
 
-import "strings"
+import (
+	"fmt"
+	"strings"
+)
 
 type Model struct {
 	Name         string
-	Input_price  float64
-	Output_price float64
+	Input_price  float64 //USD per 1M tokens
+	Output_price float64 //USD per 1M tokens
+
+	//USD per 1M tokens, 0 = derived from Input_price(Anthropic: write 1.25x, read 0.1x, others: read 0.5x)
+	Cache_write_price float64 `json:",omitempty"`
+	Cache_read_price  float64 `json:",omitempty"`
+
+	Caps *ModelCaps `json:",omitempty"` //nil = g_model_caps_unknown
+}
+
+// ModelCaps.System_prompt
+const (
+	ModelCaps_system_default = ""     //"system" message or Anthropic's top-level system
+	ModelCaps_system_user    = "user" //model has no system role, prompt is put at the beginning of the first user message
+)
+
+// What model supports. Requests are adapted to it and use case picks models which can handle the agent.
+type ModelCaps struct {
+	Context_tokens    int //0 = unknown
+	Max_output_tokens int //0 = unknown
+
+	Tools          bool
+	Parallel_tools bool //more tool calls in one answer
+	Vision         bool //images in messages
+	Json_schema    bool //response_format
+	Streaming      bool
+
+	System_prompt string
 }
 
+// Used for models without Caps.
+var g_model_caps_unknown = ModelCaps{Tools: true, Parallel_tools: true, Streaming: true}
+
 type Service struct {
 	Name                     string
 	OpenAI_completion_url    string
@@ -32,25 +64,37 @@ type Service struct {
 
 	Models        []Model
 	Default_model string
+
+	No_prompt_cache bool `json:",omitempty"` //Anthropic: don't send cache breakpoints(system, tools, last message)
+
+	//retry on rate limit, overloaded or network error
+	Max_retries     *int    `json:",omitempty"` //nil = default(5), 0 = never retry
+	Retry_min_delay float64 //seconds, 0 = default(1)
+	Retry_max_delay float64 //seconds, 0 = default(60)
 }
 
+// [use case]models. When model fails(provider error, rate limit, context overflow), the next one is used.
+// Built-in default, models.json or SKY_AGENT_USE_CASE_<USE_CASE> can change it.
 // grok-2
 // gpt-4o-mini
 // mistral-large-latest
 // mistral-small-latest
 // codestral-latest
-const g_model_agent = "grok-2"
-const g_model_coder = "grok-2"
-const g_model_search = "llama-3.1-sonar-large-128k-online"
+var g_use_cases = map[string]ModelsChain{
+	"agent":  {"grok-2"},
+	"coder":  {"grok-2"},
+	"search": {"llama-3.1-sonar-large-128k-online"},
+}
 
+// Built-in default, models.json replaces it. API keys are usually set by SKY_AGENT_<SERVICE>_API_KEY.
 var g_services = []Service{
 	{Name: "xai", OpenAI_completion_url: "https://api.x.ai/v1/chat/completions" /*, Anthropic_completion_url: "https://api.x.ai/v1/messages"*/, Api_key: "<your_api_key>",
 		Models: []Model{
 			//https://docs.x.ai/docs/models
-			{Name: "grok-2-vision", Input_price: 2, Output_price: 10},
-			{Name: "grok-2", Input_price: 2, Output_price: 10},
-			{Name: "grok-vision-beta", Input_price: 2, Output_price: 15},
-			{Name: "grok-beta", Input_price: 2, Output_price: 15},
+			{Name: "grok-2-vision", Input_price: 2, Output_price: 10, Caps: &ModelCaps{Context_tokens: 32768, Tools: true, Parallel_tools: true, Vision: true, Json_schema: true, Streaming: true}},
+			{Name: "grok-2", Input_price: 2, Output_price: 10, Caps: &ModelCaps{Context_tokens: 131072, Tools: true, Parallel_tools: true, Json_schema: true, Streaming: true}},
+			{Name: "grok-vision-beta", Input_price: 2, Output_price: 15, Caps: &ModelCaps{Context_tokens: 8192, Tools: true, Parallel_tools: true, Vision: true, Streaming: true}},
+			{Name: "grok-beta", Input_price: 2, Output_price: 15, Caps: &ModelCaps{Context_tokens: 131072, Tools: true, Parallel_tools: true, Streaming: true}},
 		},
 	},
 
@@ -58,42 +102,42 @@ var g_services = []Service{
 		Models: []Model{
 			//https://platform.openai.com/docs/pricing
 			//{Name: "gpt-3.5-turbo", Input_price: 0.5, Output_price: 1.5},
-			{Name: "gpt-4", Input_price: 30, Output_price: 60},
-			{Name: "gpt-4-turbo", Input_price: 10, Output_price: 30},
-			{Name: "gpt-4o", Input_price: 2.5, Output_price: 10},
-			{Name: "gpt-4o-mini", Input_price: 0.15, Output_price: 0.6},
+			{Name: "gpt-4", Input_price: 30, Output_price: 60, Caps: &ModelCaps{Context_tokens: 8192, Max_output_tokens: 8192, Tools: true, Parallel_tools: true, Streaming: true}},
+			{Name: "gpt-4-turbo", Input_price: 10, Output_price: 30, Caps: &ModelCaps{Context_tokens: 128000, Max_output_tokens: 4096, Tools: true, Parallel_tools: true, Vision: true, Streaming: true}},
+			{Name: "gpt-4o", Input_price: 2.5, Output_price: 10, Caps: &ModelCaps{Context_tokens: 128000, Max_output_tokens: 16384, Tools: true, Parallel_tools: true, Vision: true, Json_schema: true, Streaming: true}},
+			{Name: "gpt-4o-mini", Input_price: 0.15, Output_price: 0.6, Caps: &ModelCaps{Context_tokens: 128000, Max_output_tokens: 16384, Tools: true, Parallel_tools: true, Vision: true, Json_schema: true, Streaming: true}},
 			//{Name: "o1", Input_price: 15, Output_price: 60},
 			//{Name: "o1-mini", Input_price: 3, Output_price: 12},
 		},
 	},
 
-	{Name: "anthropic", Anthropic_completion_url: "https://api.anthropic.com/v1/messages", Api_key: "<your_api_key>",
+	{Name: "anthropic", Anthropic_completion_url: "https://api.anthropic.com/v1/messages", Api_key: "<your_api_key>", Max_retries: Completion_maxRetries(8), Retry_max_delay: 120, //529 overloaded is common
 		Models: []Model{
 			//https://www.anthropic.com/pricing#anthropic-api
-			{Name: "claude-3-5-haiku-latest", Input_price: 0.8, Output_price: 4},
-			{Name: "claude-3-5-sonnet-latest", Input_price: 3, Output_price: 15},
+			{Name: "claude-3-5-haiku-latest", Input_price: 0.8, Output_price: 4, Caps: &ModelCaps{Context_tokens: 200000, Max_output_tokens: 8192, Tools: true, Parallel_tools: true, Streaming: true}},
+			{Name: "claude-3-5-sonnet-latest", Input_price: 3, Output_price: 15, Caps: &ModelCaps{Context_tokens: 200000, Max_output_tokens: 8192, Tools: true, Parallel_tools: true, Vision: true, Streaming: true}},
 		},
 	},
 
 	{Name: "mistral", OpenAI_completion_url: "https://api.mistral.ai/v1/chat/completions", Api_key: "<your_api_key>",
 		Models: []Model{
 			//https://mistral.ai/technology/#pricing
-			{Name: "mistral-large-latest", Input_price: 2, Output_price: 6},
-			{Name: "pixtral-large-latest", Input_price: 2, Output_price: 6},
-			{Name: "mistral-small-latest", Input_price: 0.2, Output_price: 0.6},
-			{Name: "codestral-latest", Input_price: 0.3, Output_price: 0.9},
-			{Name: "pixtral-12b-2409", Input_price: 0.15, Output_price: 0.15},  //free?
-			{Name: "open-mistral-nemo", Input_price: 0.15, Output_price: 0.15}, //free?
+			{Name: "mistral-large-latest", Input_price: 2, Output_price: 6, Caps: &ModelCaps{Context_tokens: 131072, Tools: true, Parallel_tools: true, Json_schema: true, Streaming: true}},
+			{Name: "pixtral-large-latest", Input_price: 2, Output_price: 6, Caps: &ModelCaps{Context_tokens: 131072, Tools: true, Parallel_tools: true, Vision: true, Json_schema: true, Streaming: true}},
+			{Name: "mistral-small-latest", Input_price: 0.2, Output_price: 0.6, Caps: &ModelCaps{Context_tokens: 32768, Tools: true, Parallel_tools: true, Json_schema: true, Streaming: true}},
+			{Name: "codestral-latest", Input_price: 0.3, Output_price: 0.9, Caps: &ModelCaps{Context_tokens: 32768, Tools: true, Parallel_tools: true, Streaming: true}},
+			{Name: "pixtral-12b-2409", Input_price: 0.15, Output_price: 0.15, Caps: &ModelCaps{Context_tokens: 131072, Tools: true, Parallel_tools: true, Vision: true, Streaming: true}}, //free?
+			{Name: "open-mistral-nemo", Input_price: 0.15, Output_price: 0.15, Caps: &ModelCaps{Context_tokens: 131072, Tools: true, Parallel_tools: true, Streaming: true}},              //free?
 		},
 	},
 
 	{Name: "groq", OpenAI_completion_url: "https://api.groq.com/openai/v1/chat/completions", Api_key: "<your_api_key>",
 		Models: []Model{
 			//https://groq.com/pricing/
-			{Name: "llama-3.3-70b-versatile", Input_price: 0.59, Output_price: 0.79},
-			{Name: "llama-3.3-70b-specdec", Input_price: 0.59, Output_price: 0.99},
-			{Name: "llama-3.1-8b-instant", Input_price: 0.05, Output_price: 0.08},
-			{Name: "gemma2-9b-it", Input_price: 0.2, Output_price: 0.2},
+			{Name: "llama-3.3-70b-versatile", Input_price: 0.59, Output_price: 0.79, Caps: &ModelCaps{Context_tokens: 131072, Max_output_tokens: 32768, Tools: true, Parallel_tools: true, Streaming: true}},
+			{Name: "llama-3.3-70b-specdec", Input_price: 0.59, Output_price: 0.99, Caps: &ModelCaps{Context_tokens: 8192, Max_output_tokens: 8192, Streaming: true}},
+			{Name: "llama-3.1-8b-instant", Input_price: 0.05, Output_price: 0.08, Caps: &ModelCaps{Context_tokens: 131072, Max_output_tokens: 8192, Tools: true, Parallel_tools: true, Streaming: true}},
+			{Name: "gemma2-9b-it", Input_price: 0.2, Output_price: 0.2, Caps: &ModelCaps{Context_tokens: 8192, Tools: true, Streaming: true}},
 			//{Name: "deepseek-r1-distill-llama-70b", Input_price: 0.59, Output_price: 0.79},
 		},
 	},
@@ -101,21 +145,21 @@ var g_services = []Service{
 	{Name: "google", OpenAI_completion_url: "https://generativelanguage.googleapis.com/v1beta/chat/completions", Api_key: "<your_api_key>-8",
 		Models: []Model{
 			//...
-			{Name: "gemini-1.5-flash", Input_price: 0, Output_price: 0},     //price? ...
-			{Name: "gemini-2.0-flash-exp", Input_price: 0, Output_price: 0}, //price? ...
+			{Name: "gemini-1.5-flash", Input_price: 0, Output_price: 0, Caps: &ModelCaps{Context_tokens: 1048576, Max_output_tokens: 8192, Tools: true, Parallel_tools: true, Vision: true, Json_schema: true, Streaming: true}},     //price? ...
+			{Name: "gemini-2.0-flash-exp", Input_price: 0, Output_price: 0, Caps: &ModelCaps{Context_tokens: 1048576, Max_output_tokens: 8192, Tools: true, Parallel_tools: true, Vision: true, Json_schema: true, Streaming: true}}, //price? ...
 		},
 	},
 
 	{Name: "perplexity", OpenAI_completion_url: "https://api.perplexity.ai/chat/completions", Api_key: "<your_api_key>",
 		Models: []Model{
 			//https://docs.perplexity.ai/guides/pricing
-			{Name: "llama-3.1-sonar-small-128k-online", Input_price: 0.2, Output_price: 0.2},
-			{Name: "llama-3.1-sonar-large-128k-online", Input_price: 1, Output_price: 1},
-			{Name: "llama-3.1-sonar-huge-128k-online", Input_price: 5, Output_price: 5},
+			{Name: "llama-3.1-sonar-small-128k-online", Input_price: 0.2, Output_price: 0.2, Caps: &ModelCaps{Context_tokens: 127072, Streaming: true}},
+			{Name: "llama-3.1-sonar-large-128k-online", Input_price: 1, Output_price: 1, Caps: &ModelCaps{Context_tokens: 127072, Streaming: true}},
+			{Name: "llama-3.1-sonar-huge-128k-online", Input_price: 5, Output_price: 5, Caps: &ModelCaps{Context_tokens: 127072, Streaming: true}},
 		},
 	},
 
-	{Name: "local", OpenAI_completion_url: "http://localhost:8090/v1/chat/completions", //8090 = port number. Replace it
+	{Name: "local", OpenAI_completion_url: "http://localhost:8090/v1/chat/completions", Max_retries: Completion_maxRetries(0), //8090 = port number. Replace it
 		Models: []Model{
 			//{Name: "name_of_model", Input_price: 0, Output_price: 0},
 		},
@@ -145,14 +189,57 @@ func Service_findService(model string) *Service {
 	return nil
 }
 
-func Service_findModelFromUse_cases(use_case string) string {
-	switch strings.ToLower(use_case) {
-	case "agent":
-		return g_model_agent
-	case "coder":
-		return g_model_coder
-	case "search":
-		return g_model_search
+// Returns model's capabilities, unknown model gets g_model_caps_unknown.
+func Service_findModelCaps(model string) *ModelCaps {
+	md := Service_findModel(model)
+	if md == nil || md.Caps == nil {
+		caps := g_model_caps_unknown
+		return &caps
+	}
+	return md.Caps
+}
+
+// Returns price of one LLM call in USD. Input_tokens are without cached tokens. Unknown model costs 0.
+func Service_getCost(model string, usage AgentUsage) float64 {
+	md := Service_findModel(model)
+	if md == nil {
+		return 0
+	}
+	service := Service_findService(model)
+
+	write_price := md.Cache_write_price
+	read_price := md.Cache_read_price
+	if write_price == 0 {
+		write_price = md.Input_price
+		if service.Anthropic_completion_url != "" {
+			write_price = md.Input_price * 1.25
+		}
+	}
+	if read_price == 0 {
+		read_price = md.Input_price * 0.5
+		if service.Anthropic_completion_url != "" {
+			read_price = md.Input_price * 0.1
+		}
+	}
+
+	cost := float64(usage.Input_tokens)*md.Input_price +
+		float64(usage.Cache_write_tokens)*write_price +
+		float64(usage.Cache_read_tokens)*read_price +
+		float64(usage.Output_tokens)*md.Output_price
+	return cost / 1000000
+}
+
+// Returns true if service exists and has api_key.
+func Service_isReady(service *Service) bool {
+	return service != nil && !strings.HasPrefix(service.Api_key, "<your_api_key>")
+}
+
+// Returns models for use case. Unknown use case gets "agent" models.
+func Service_findModelsFromUse_case(use_case string) []string {
+	models, found := g_use_cases[strings.ToLower(use_case)]
+	if !found {
+		fmt.Printf("Warning: use case '%s' not found, using 'agent'\n", use_case)
+		models = g_use_cases["agent"] //default
 	}
-	return g_model_agent //default
+	return models
 }
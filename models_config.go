@@ -0,0 +1,218 @@
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// models.json. Built-in g_services and g_use_cases are used, when file doesn't exist.
+type ModelsConfig struct {
+	Services  []Service              //replace g_services and g_use_cases, when not empty
+	Use_cases map[string]ModelsChain //[use case]models, "agent" is the default
+}
+
+// Models in order of preference. In JSON it can be one string or array.
+type ModelsChain []string
+
+func (chain *ModelsChain) UnmarshalJSON(js []byte) error {
+	var model string
+	if json.Unmarshal(js, &model) == nil {
+		*chain = ModelsChain{model}
+		return nil
+	}
+	return json.Unmarshal(js, (*[]string)(chain))
+}
+
+// Reads config, applies env overrides and replaces g_services and g_use_cases.
+//
+// Env overrides:
+// SKY_AGENT_<SERVICE>_API_KEY, for example SKY_AGENT_OPENAI_API_KEY
+// SKY_AGENT_<SERVICE>_URL, completion url(OpenAI or Anthropic, depending on service)
+// SKY_AGENT_USE_CASE_<USE_CASE>=models, for example SKY_AGENT_USE_CASE_CODER=gpt-4o,claude-3-5-sonnet-latest
+func LoadModelsConfig(path string) error {
+	config := ModelsConfig{Use_cases: map[string]ModelsChain{}}
+
+	js, err := os.ReadFile(path)
+	exists := err == nil
+	if exists {
+		dec := json.NewDecoder(bytes.NewReader(js))
+		dec.DisallowUnknownFields() //typo in field name would be silently ignored
+		err = dec.Decode(&config)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	services := g_services
+	use_cases := map[string]ModelsChain{}
+	if len(config.Services) > 0 {
+		services = config.Services //built-in use cases point to built-in services
+	} else {
+		for use_case, model := range g_use_cases {
+			use_cases[use_case] = model
+		}
+	}
+	services = append([]Service{}, services...) //g_services stays untouched, when validation fails
+
+	for use_case, models := range config.Use_cases {
+		use_cases[strings.ToLower(use_case)] = models
+	}
+
+	//env
+	for i := range services {
+		if key := os.Getenv(Service_envName(services[i].Name, "API_KEY")); key != "" {
+			services[i].Api_key = key
+		}
+		if u := os.Getenv(Service_envName(services[i].Name, "URL")); u != "" {
+			if services[i].Anthropic_completion_url != "" {
+				services[i].Anthropic_completion_url = u
+			} else {
+				services[i].OpenAI_completion_url = u
+			}
+		}
+	}
+	for _, env := range os.Environ() {
+		name, models, _ := strings.Cut(env, "=")
+		if use_case, found := strings.CutPrefix(name, "SKY_AGENT_USE_CASE_"); found && use_case != "" {
+			var chain ModelsChain
+			for _, model := range strings.Split(models, ",") {
+				if model = strings.TrimSpace(model); model != "" {
+					chain = append(chain, model)
+				}
+			}
+			use_cases[strings.ToLower(use_case)] = chain
+		}
+	}
+
+	err = _modelsConfig_check(services, use_cases)
+	if err != nil {
+		if exists {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		return err
+	}
+
+	g_services = services
+	g_use_cases = use_cases
+	return nil
+}
+
+// Returns SKY_AGENT_<SERVICE>_<name>.
+func Service_envName(service string, name string) string {
+	var sb strings.Builder
+	for _, c := range strings.ToUpper(service) {
+		if (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+			sb.WriteRune(c)
+		} else {
+			sb.WriteByte('_')
+		}
+	}
+	return "SKY_AGENT_" + sb.String() + "_" + name
+}
+
+func _modelsConfig_check(services []Service, use_cases map[string]ModelsChain) error {
+	service_names := map[string]bool{}
+	model_names := map[string]string{} //[model]service
+	for i, srv := range services {
+		if srv.Name == "" {
+			return fmt.Errorf("Services[%d] has no Name", i)
+		}
+		name := strings.ToLower(srv.Name)
+		if service_names[name] {
+			return fmt.Errorf("service '%s' is defined twice", srv.Name)
+		}
+		service_names[name] = true
+
+		switch {
+		case srv.OpenAI_completion_url == "" && srv.Anthropic_completion_url == "":
+			return fmt.Errorf("service '%s' needs OpenAI_completion_url or Anthropic_completion_url", srv.Name)
+		case srv.OpenAI_completion_url != "" && srv.Anthropic_completion_url != "":
+			return fmt.Errorf("service '%s' can have only one of OpenAI_completion_url and Anthropic_completion_url", srv.Name)
+		}
+		for _, u := range []string{srv.OpenAI_completion_url, srv.Anthropic_completion_url} {
+			if u == "" {
+				continue
+			}
+			pu, err := url.Parse(u)
+			if err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" {
+				return fmt.Errorf("service '%s' has invalid completion url '%s'", srv.Name, u)
+			}
+		}
+		if srv.Max_retries != nil && *srv.Max_retries < 0 {
+			return fmt.Errorf("service '%s' has negative Max_retries, use 0 to turn retries off", srv.Name)
+		}
+		if srv.Retry_min_delay < 0 || srv.Retry_max_delay < 0 {
+			return fmt.Errorf("service '%s' has negative Retry_min_delay or Retry_max_delay", srv.Name)
+		}
+
+		for _, md := range srv.Models {
+			if md.Name == "" {
+				return fmt.Errorf("service '%s' has model without Name", srv.Name)
+			}
+			if md.Name != strings.ToLower(md.Name) {
+				return fmt.Errorf("model '%s' of service '%s' must be lowercase", md.Name, srv.Name)
+			}
+			if other, found := model_names[md.Name]; found {
+				return fmt.Errorf("model '%s' is in services '%s' and '%s'", md.Name, other, srv.Name)
+			}
+			model_names[md.Name] = srv.Name
+			if md.Input_price < 0 || md.Output_price < 0 || md.Cache_write_price < 0 || md.Cache_read_price < 0 {
+				return fmt.Errorf("model '%s' has negative price", md.Name)
+			}
+			if md.Caps != nil {
+				if md.Caps.Context_tokens < 0 || md.Caps.Max_output_tokens < 0 {
+					return fmt.Errorf("model '%s' has negative Caps.Context_tokens or Caps.Max_output_tokens", md.Name)
+				}
+				if md.Caps.System_prompt != ModelCaps_system_default && md.Caps.System_prompt != ModelCaps_system_user {
+					return fmt.Errorf("model '%s' has invalid Caps.System_prompt '%s', use \"\" or '%s'", md.Name, md.Caps.System_prompt, ModelCaps_system_user)
+				}
+			}
+		}
+		if srv.Default_model != "" && model_names[strings.ToLower(srv.Default_model)] != srv.Name {
+			return fmt.Errorf("Default_model '%s' of service '%s' is not in its Models", srv.Default_model, srv.Name)
+		}
+	}
+
+	var ucs []string
+	for use_case := range use_cases {
+		ucs = append(ucs, use_case)
+	}
+	sort.Strings(ucs) //same error every run
+	for _, use_case := range ucs {
+		if len(use_cases[use_case]) == 0 {
+			return fmt.Errorf("use case '%s' has no models", use_case)
+		}
+		for _, model := range use_cases[use_case] {
+			if _, found := model_names[strings.ToLower(model)]; !found {
+				return fmt.Errorf("use case '%s' has model '%s', which is not in any service", use_case, model)
+			}
+		}
+	}
+	if _, found := use_cases["agent"]; !found {
+		return fmt.Errorf("use case 'agent' is missing, it's the default")
+	}
+	return nil
+}
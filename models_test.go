@@ -0,0 +1,216 @@
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func _testAdapt_openAI() OpenAI_completion_props {
+	var props OpenAI_completion_props
+	props.ResetDefault()
+	props.Max_tokens = 16000
+	props.Response_format = &OpenAI_completion_format{Type: "json_object"}
+	props.Tools = []*OpenAI_completion_tool{NewOpenAI_completion_tool("get_weather", "Returns weather")}
+
+	user := OpenAI_completion_msg{Role: "user"}
+	user.AddText("What is in the picture?")
+	user.AddImage([]byte("png"), "png")
+	props.Messages = []interface{}{OpenAI_completion_msgPlain{Role: "system", Content: "Be brief."}, user}
+	return props
+}
+
+func _testAdapt_anthropic() Anthropic_completion_props {
+	var props Anthropic_completion_props
+	props.ResetDefault()
+	props.Max_tokens = 16000
+	props.System = "Be brief."
+	props.Tools = []*Anthropic_completion_tool{NewAnthropic_completion_tool("get_weather", "Returns weather")}
+
+	user := Anthropic_completion_msg{Role: "user"}
+	user.AddText("What is in the picture?")
+	user.AddImage([]byte("png"), "png")
+	props.Messages = []Anthropic_completion_msg{user}
+	return props
+}
+
+func TestAdaptToModel(t *testing.T) {
+	all := ModelCaps{Context_tokens: 128000, Max_output_tokens: 32000, Tools: true, Parallel_tools: true, Vision: true, Json_schema: true, Streaming: true}
+
+	tests := []struct {
+		name string
+		caps func(caps *ModelCaps)
+
+		tools     bool
+		parallel  bool //false = disabled in request
+		maxTokens int
+		stream    bool
+		format    bool
+		image     bool
+		system    string //"top" = system message/field, "user" = in the first user message
+	}{
+		{"everything", func(caps *ModelCaps) {}, true, true, 16000, true, true, true, "top"},
+		{"no tools", func(caps *ModelCaps) { caps.Tools = false }, false, true, 16000, true, true, true, "top"},
+		{"no parallel tools", func(caps *ModelCaps) { caps.Parallel_tools = false }, true, false, 16000, true, true, true, "top"},
+		{"small output", func(caps *ModelCaps) { caps.Max_output_tokens = 8192 }, true, true, 8192, true, true, true, "top"},
+		{"unknown output", func(caps *ModelCaps) { caps.Max_output_tokens = 0 }, true, true, 16000, true, true, true, "top"},
+		{"no streaming", func(caps *ModelCaps) { caps.Streaming = false }, true, true, 16000, false, true, true, "top"},
+		{"no json schema", func(caps *ModelCaps) { caps.Json_schema = false }, true, true, 16000, true, false, true, "top"},
+		{"no vision", func(caps *ModelCaps) { caps.Vision = false }, true, true, 16000, true, true, false, "top"},
+		{"system in user", func(caps *ModelCaps) { caps.System_prompt = ModelCaps_system_user }, true, true, 16000, true, true, true, "user"},
+		{"unknown model", func(caps *ModelCaps) { *caps = g_model_caps_unknown }, true, true, 16000, true, false, false, "top"},
+	}
+	for _, tt := range tests {
+		caps := all
+		tt.caps(&caps)
+
+		t.Run("openai "+tt.name, func(t *testing.T) {
+			props := _testAdapt_openAI()
+			orig, _ := json.Marshal(props)
+			out := props.AdaptToModel(&caps)
+			if after, _ := json.Marshal(props); string(after) != string(orig) {
+				t.Fatal("original props were changed")
+			}
+
+			if (len(out.Tools) > 0) != tt.tools {
+				t.Errorf("tools: %d", len(out.Tools))
+			}
+			if tt.tools && tt.parallel != (out.Parallel_tool_calls == nil) {
+				t.Errorf("parallel_tool_calls: %v", out.Parallel_tool_calls)
+			}
+			if tt.tools && !tt.parallel && *out.Parallel_tool_calls {
+				t.Error("parallel_tool_calls is true")
+			}
+			if !tt.tools && out.Parallel_tool_calls != nil {
+				t.Error("parallel_tool_calls without tools")
+			}
+			if out.Max_tokens != tt.maxTokens {
+				t.Errorf("max_tokens: %d", out.Max_tokens)
+			}
+			if out.Stream != tt.stream || (out.Stream_options != nil) != tt.stream {
+				t.Errorf("stream: %v, %v", out.Stream, out.Stream_options)
+			}
+			if (out.Response_format != nil) != tt.format {
+				t.Errorf("response_format: %v", out.Response_format)
+			}
+
+			js, _ := json.Marshal(out.Messages)
+			if strings.Contains(string(js), `"image_url"`) != tt.image || strings.Contains(string(js), "image was removed") == tt.image {
+				t.Errorf("image: %s", js)
+			}
+			var msgs []struct {
+				Role    string
+				Content json.RawMessage
+			}
+			json.Unmarshal(js, &msgs)
+			switch tt.system {
+			case "top":
+				if len(msgs) != 2 || msgs[0].Role != "system" {
+					t.Errorf("system message: %s", js)
+				}
+			case "user":
+				if len(msgs) != 1 || msgs[0].Role != "user" || !strings.HasPrefix(string(msgs[0].Content), `[{"type":"text","text":"Be brief."}`) {
+					t.Errorf("system in user message: %s", js)
+				}
+			}
+		})
+
+		t.Run("anthropic "+tt.name, func(t *testing.T) {
+			props := _testAdapt_anthropic()
+			orig, _ := json.Marshal(props)
+			out := props.AdaptToModel(&caps)
+			if after, _ := json.Marshal(props); string(after) != string(orig) {
+				t.Fatal("original props were changed")
+			}
+
+			if (len(out.Tools) > 0) != tt.tools {
+				t.Errorf("tools: %d", len(out.Tools))
+			}
+			if tt.tools && tt.parallel != (out.Tool_choice == nil) {
+				t.Errorf("tool_choice: %v", out.Tool_choice)
+			}
+			if out.Tool_choice != nil && (!out.Tool_choice.Disable_parallel_tool_use || !tt.tools) {
+				t.Errorf("tool_choice: %+v", out.Tool_choice)
+			}
+			if out.Max_tokens != tt.maxTokens {
+				t.Errorf("max_tokens: %d", out.Max_tokens)
+			}
+			if out.Stream != tt.stream {
+				t.Errorf("stream: %v", out.Stream)
+			}
+
+			content := out.Messages[0].Content
+			hasImage := false
+			for _, it := range content {
+				if it.Type == "image" {
+					hasImage = true
+				}
+			}
+			if hasImage != tt.image {
+				t.Errorf("image: %+v", content)
+			}
+			switch tt.system {
+			case "top":
+				if out.System != "Be brief." || content[0].Text == "Be brief." {
+					t.Errorf("system: '%s', %+v", out.System, content)
+				}
+			case "user":
+				if out.System != "" || content[0].Text != "Be brief." || len(content) != 3 {
+					t.Errorf("system in user message: '%s', %+v", out.System, content)
+				}
+			}
+		})
+	}
+}
+
+// Routing picks the first model, which can handle the conversation.
+func TestAgentPickModel(t *testing.T) {
+	services := g_services
+	defer func() { g_services = services }()
+	g_services = []Service{
+		{Name: "a", Api_key: "key", Models: []Model{
+			{Name: "text-only", Caps: &ModelCaps{Context_tokens: 8000, Streaming: true}},
+			{Name: "small", Caps: &ModelCaps{Context_tokens: 8000, Tools: true, Vision: true}},
+			{Name: "large", Caps: &ModelCaps{Context_tokens: 200000, Tools: true}},
+		}},
+		{Name: "b", Api_key: "<your_api_key>", Models: []Model{
+			{Name: "no-key", Caps: &ModelCaps{Tools: true, Vision: true}},
+		}},
+	}
+	models := []string{"no-key", "text-only", "small", "large"}
+
+	tests := []struct {
+		tools  bool
+		vision bool
+		tokens int
+		want   string
+	}{
+		{false, false, 1000, "text-only"},
+		{true, false, 1000, "small"},
+		{false, true, 1000, "small"},
+		{true, false, 50000, "large"},
+		{true, true, 50000, "text-only"}, //nothing fits, first ready model
+	}
+	for _, tt := range tests {
+		got := _agent_pickModel(models, tt.tools, tt.vision, tt.tokens)
+		if got != tt.want {
+			t.Errorf("tools=%v vision=%v tokens=%d: got '%s', want '%s'", tt.tools, tt.vision, tt.tokens, got, tt.want)
+		}
+	}
+}
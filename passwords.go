@@ -17,59 +17,629 @@ limitations under the License.
 package main
 
 import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"log"
+	"net"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// Secrets are stored encrypted in passwords.vault. Tools and LLM see only password_id, SDK_GetPassword() converts it into password.
+
+const (
+	Passwords_key_env        = "SKY_AGENT_VAULT_KEY"        //hex-encoded 32 bytes key
+	Passwords_key_file_env   = "SKY_AGENT_VAULT_KEY_FILE"   //file with hex-encoded 32 bytes key
+	Passwords_passphrase_env = "SKY_AGENT_VAULT_PASSPHRASE" //otherwise passphrase is asked on terminal
+)
+
+// Passwords_vault.Kdf
+const (
+	Passwords_kdf_scrypt = "scrypt" //key is derived from passphrase
+	Passwords_kdf_raw    = "raw"    //key is from env var or key file
 )
 
+// passwords.vault
+type Passwords_vault struct {
+	Version int
+	Kdf     string
+	Salt    []byte `json:",omitempty"`
+	N       int    `json:",omitempty"` //scrypt parameters
+	R       int    `json:",omitempty"`
+	P       int    `json:",omitempty"`
+	Nonce   []byte
+	Data    []byte //AES-256-GCM of JSON map[id]Passwords_secret
+}
+
+// Vault entry. Empty Tools/Hosts = no restriction.
+type Passwords_secret struct {
+	Password string
+	Tools    []string `json:",omitempty"` //filepath.Match() patterns of tool folders, for example "tools/send_email", "tools/*"
+	Hosts    []string `json:",omitempty"` //where password can be sent: "smtp.example.com", "smtp.example.com:587", "*.example.com"
+}
+
 type Passwords struct {
-	Strings map[string]string //[id]password
+	path  string
+	vault Passwords_vault
+	key   []byte
+	err   error //why vault is locked
+
+	lock     sync.Mutex
+	secrets  map[string]Passwords_secret //[id]
+	approved map[string]bool             //[tool + "\n" + id] confirmed by operator in this run
 }
 
-func NewPasswords() *Passwords {
-	rp := &Passwords{Strings: map[string]string{}}
+// Opens vault. Plaintext passwords.json from older versions is moved into vault and deleted. If vault can't be unlocked, the error is returned together with locked Passwords, which has no passwords.
+func NewPasswords(path string, plain_path string) (*Passwords, error) {
+	rp := &Passwords{path: path, secrets: map[string]Passwords_secret{}, approved: map[string]bool{}}
+	rp.err = rp.load(plain_path)
+	return rp, rp.err
+}
 
-	//open
-	js, err := os.ReadFile("passwords.json")
+func (rp *Passwords) load(plain_path string) error {
+	path := rp.path
+	js, err := os.ReadFile(path)
 	if err == nil {
-		json.Unmarshal(js, &rp.Strings)
+		err = rp.open(js)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	//migrate
+	js, err = os.ReadFile(plain_path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil //vault is created with first Add()
+		}
+		return err
+	}
+	var plain map[string]string
+	err = json.Unmarshal(js, &plain)
+	if err != nil {
+		return fmt.Errorf("%s: %w", plain_path, err)
 	}
 
-	return rp
+	fmt.Printf("Moving passwords from plaintext '%s' into encrypted '%s'.\n", plain_path, path)
+	err = rp.create()
+	if err != nil {
+		return err
+	}
+	for id, password := range plain {
+		rp.secrets[id] = Passwords_secret{Password: password}
+	}
+	err = rp.save()
+	if err != nil {
+		return err
+	}
+	return os.Remove(plain_path)
 }
 
+// Clears passwords and key from memory.
 func (rp *Passwords) Destroy() {
-	//save
-	js, err := json.Marshal(rp.Strings)
-	if err == nil {
-		os.WriteFile("passwords.json", js, 0644)
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+
+	for i := range rp.key {
+		rp.key[i] = 0
 	}
+	rp.key = nil
+	rp.err = fmt.Errorf("vault is closed")
+	rp.secrets = map[string]Passwords_secret{}
 }
 
-func (rp *Passwords) Find(id string) string {
-	for idd, password := range rp.Strings {
-		if idd == id {
-			return password
+func (rp *Passwords) Find(id string) (Passwords_secret, error) {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+
+	secret, found := rp.secrets[id]
+	if !found {
+		if rp.err != nil {
+			return Passwords_secret{}, fmt.Errorf("password vault is locked: %w", rp.err)
 		}
+		return Passwords_secret{}, fmt.Errorf("password_id '%s' not found", id)
 	}
-	return ""
+	return secret, nil
 }
 
-func (rp *Passwords) Add(password string) string {
-	idBytes := make([]byte, 20) //160bit
-	n, err := rand.Read(idBytes)
+// Checks secret's scopes. Tool's network policy must not reach hosts outside of Hosts.
+func (secret *Passwords_secret) CheckAccess(tool string, net Protocol_netPolicy) error {
+	if len(secret.Tools) > 0 {
+		tool = filepath.ToSlash(filepath.Clean(tool))
+		found := false
+		for _, pattern := range secret.Tools {
+			if ok, _ := filepath.Match(pattern, tool); ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("tool is not in password's Tools")
+		}
+	}
+
+	if len(secret.Hosts) > 0 {
+		switch net.Mode {
+		case Sandbox_net_deny:
+			//password can't leave
+		case Sandbox_net_loopback:
+			if !secret.coversHost("localhost") {
+				return fmt.Errorf("tool can connect to localhost, which is not in password's Hosts")
+			}
+		case Sandbox_net_allowlist:
+			for _, host := range net.Allow {
+				if !secret.coversHost(host) {
+					return fmt.Errorf("tool can connect to '%s', which is not in password's Hosts", host)
+				}
+			}
+		default:
+			return fmt.Errorf("tool can connect anywhere, but password has Hosts")
+		}
+	}
+	return nil
+}
+
+// Returns true if all connections allowed by host(network policy entry) go to password's Hosts.
+func (secret *Passwords_secret) coversHost(host string) bool {
+	h, port := _passwords_splitHost(host)
+	for _, pattern := range secret.Hosts {
+		ph, pport := _passwords_splitHost(pattern)
+		if pport != "" && pport != port {
+			continue
+		}
+		if strings.EqualFold(ph, h) || (strings.HasPrefix(ph, "*.") && strings.HasSuffix(strings.ToLower(h), strings.ToLower(ph[1:]))) {
+			return true
+		}
+	}
+	return false
+}
+
+func _passwords_splitHost(host string) (string, string) {
+	h, port, err := net.SplitHostPort(host)
 	if err != nil {
-		log.Fatal(err)
+		return host, "" //without port
+	}
+	return h, port
+}
+
+// Returns true, when tool was allowed to read the password before.
+func (rp *Passwords) IsApproved(tool string, id string) bool {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+	return rp.approved[tool+"\n"+id]
+}
+
+func (rp *Passwords) SetApproved(tool string, id string) {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+	rp.approved[tool+"\n"+id] = true
+}
+
+// Tool's code was changed, so operator must confirm its passwords again.
+func (rp *Passwords) RemoveApproved(tool string) {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+	for key := range rp.approved {
+		if strings.HasPrefix(key, tool+"\n") {
+			delete(rp.approved, key)
+		}
+	}
+}
+
+// Returns sorted ids.
+func (rp *Passwords) Ids() []string {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+
+	var ids []string
+	for id := range rp.secrets {
+		ids = append(ids, id)
 	}
-	if n != len(idBytes) {
-		log.Fatal(fmt.Errorf("Invalid rand.Read() size"))
+	sort.Strings(ids)
+	return ids
+}
+
+// Returns all passwords, for redaction.
+func (rp *Passwords) Values() []string {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+
+	var values []string
+	for _, secret := range rp.secrets {
+		values = append(values, secret.Password)
 	}
+	return values
+}
 
+// Saves password and returns its new id.
+func (rp *Passwords) Add(secret Passwords_secret) (string, error) {
+	idBytes := make([]byte, 20) //160bit
+	_, err := rand.Read(idBytes)
+	if err != nil {
+		return "", err
+	}
 	id := hex.EncodeToString(idBytes)
-	rp.Strings[id] = password
 
-	return id
+	err = rp.update(func() error {
+		rp.secrets[id] = secret
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Replaces password, id and scopes stay the same.
+func (rp *Passwords) Rotate(id string, password string) error {
+	return rp.update(func() error {
+		secret, found := rp.secrets[id]
+		if !found {
+			return fmt.Errorf("password_id '%s' not found", id)
+		}
+		secret.Password = password
+		rp.secrets[id] = secret
+		return nil
+	})
+}
+
+// Replaces Tools and Hosts.
+func (rp *Passwords) SetScope(id string, tools []string, hosts []string) error {
+	return rp.update(func() error {
+		secret, found := rp.secrets[id]
+		if !found {
+			return fmt.Errorf("password_id '%s' not found", id)
+		}
+		secret.Tools = tools
+		secret.Hosts = hosts
+		rp.secrets[id] = secret
+		return nil
+	})
+}
+
+func (rp *Passwords) Remove(id string) error {
+	return rp.update(func() error {
+		if _, found := rp.secrets[id]; !found {
+			return fmt.Errorf("password_id '%s' not found", id)
+		}
+		delete(rp.secrets, id)
+		return nil
+	})
+}
+
+func (rp *Passwords) update(fn func() error) error {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+
+	if rp.err != nil {
+		return fmt.Errorf("password vault is locked: %w", rp.err)
+	}
+	if rp.key == nil {
+		err := rp.create()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := fn()
+	if err != nil {
+		return err
+	}
+	return rp.save()
+}
+
+func (rp *Passwords) open(js []byte) error {
+	err := json.Unmarshal(js, &rp.vault)
+	if err != nil {
+		return err
+	}
+	if rp.vault.Version != 1 {
+		return fmt.Errorf("unsupported vault version %d", rp.vault.Version)
+	}
+
+	if st, err := os.Stat(rp.path); err == nil && st.Mode().Perm()&0077 != 0 {
+		fmt.Printf("Warning: '%s' is readable by other users, changing permissions to 0600\n", rp.path)
+		os.Chmod(rp.path, 0600)
+	}
+
+	var key []byte
+	switch rp.vault.Kdf {
+	case Passwords_kdf_raw:
+		key, err = _passwords_rawKey()
+		if err == nil && key == nil {
+			err = fmt.Errorf("vault is encrypted by key, set %s or %s", Passwords_key_env, Passwords_key_file_env)
+		}
+	case Passwords_kdf_scrypt:
+		var passphrase []byte
+		passphrase, err = _passwords_passphrase(false)
+		if err == nil {
+			key, err = scrypt.Key(passphrase, rp.vault.Salt, rp.vault.N, rp.vault.R, rp.vault.P, 32)
+		}
+	default:
+		err = fmt.Errorf("unknown Kdf '%s'", rp.vault.Kdf)
+	}
+	if err != nil {
+		return err
+	}
+
+	gcm, err := _passwords_cipher(key)
+	if err != nil {
+		return err
+	}
+	plain, err := gcm.Open(nil, rp.vault.Nonce, rp.vault.Data, rp.vault.additionalData())
+	if err != nil {
+		return fmt.Errorf("wrong passphrase or key, or vault is damaged")
+	}
+	err = json.Unmarshal(plain, &rp.secrets)
+	if err != nil {
+		//first vault version had only passwords
+		var old map[string]string
+		if json.Unmarshal(plain, &old) != nil {
+			return err
+		}
+		for id, password := range old {
+			rp.secrets[id] = Passwords_secret{Password: password}
+		}
+	}
+
+	rp.key = key
+	return nil
+}
+
+// Sets up new key for vault, which doesn't exist yet.
+func (rp *Passwords) create() error {
+	key, err := _passwords_rawKey()
+	if err != nil {
+		return err
+	}
+	if key != nil {
+		rp.vault = Passwords_vault{Version: 1, Kdf: Passwords_kdf_raw}
+		rp.key = key
+		return nil
+	}
+
+	passphrase, err := _passwords_passphrase(true)
+	if err != nil {
+		return err
+	}
+	vault := Passwords_vault{Version: 1, Kdf: Passwords_kdf_scrypt, Salt: make([]byte, 16), N: 1 << 15, R: 8, P: 1}
+	_, err = rand.Read(vault.Salt)
+	if err != nil {
+		return err
+	}
+	key, err = scrypt.Key(passphrase, vault.Salt, vault.N, vault.R, vault.P, 32)
+	if err != nil {
+		return err
+	}
+	rp.vault = vault
+	rp.key = key
+	return nil
+}
+
+// Encrypts with new nonce and writes file atomically.
+func (rp *Passwords) save() error {
+	plain, err := json.Marshal(rp.secrets)
+	if err != nil {
+		return err
+	}
+	gcm, err := _passwords_cipher(rp.key)
+	if err != nil {
+		return err
+	}
+	rp.vault.Nonce = make([]byte, gcm.NonceSize())
+	_, err = rand.Read(rp.vault.Nonce)
+	if err != nil {
+		return err
+	}
+	rp.vault.Data = gcm.Seal(nil, rp.vault.Nonce, plain, rp.vault.additionalData())
+
+	js, err := json.MarshalIndent(&rp.vault, "", "\t")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(rp.path, js, 0600)
+}
+
+// Header is authenticated, so KDF parameters can't be changed.
+func (vault *Passwords_vault) additionalData() []byte {
+	return []byte(fmt.Sprintf("sky_agent vault %d %s %x %d %d %d", vault.Version, vault.Kdf, vault.Salt, vault.N, vault.R, vault.P))
+}
+
+func _passwords_cipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Returns nil, when key is not set.
+func _passwords_rawKey() ([]byte, error) {
+	str := os.Getenv(Passwords_key_env)
+	src := Passwords_key_env
+	if str == "" {
+		path := os.Getenv(Passwords_key_file_env)
+		if path == "" {
+			return nil, nil
+		}
+		js, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		str = string(js)
+		src = path
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(str))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s: key must be 64 hex characters(32 bytes)", src)
+	}
+	return key, nil
+}
+
+func _passwords_passphrase(confirm bool) ([]byte, error) {
+	if str := os.Getenv(Passwords_passphrase_env); str != "" {
+		return []byte(str), nil
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, fmt.Errorf("no key for password vault, set %s, %s or %s", Passwords_passphrase_env, Passwords_key_env, Passwords_key_file_env)
+	}
+
+	passphrase, err := _passwords_readSecret("Vault passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	if confirm {
+		again, err := _passwords_readSecret("Repeat vault passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		if string(again) != string(passphrase) {
+			return nil, fmt.Errorf("passphrases don't match")
+		}
+	}
+	return passphrase, nil
+}
+
+var g_passwords_stdin = bufio.NewReader(os.Stdin)
+
+// Reads line without echo from terminal, or from piped stdin.
+func _passwords_readSecret(prompt string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		fmt.Print(prompt)
+		str, err := term.ReadPassword(fd)
+		fmt.Println()
+		return str, err
+	}
+
+	ln, err := g_passwords_stdin.ReadString('\n')
+	if err != nil && ln == "" {
+		return nil, err
+	}
+	return []byte(strings.TrimRight(ln, "\r\n")), nil
+}
+
+// `sky_agent vault <command>`. Returns exit code.
+func Passwords_runCommand(args []string) int {
+	usage := func() int {
+		fmt.Println("Usage: sky_agent vault add [-tools ...] [-hosts ...] | list | rotate <password_id> | scope [-tools ...] [-hosts ...] <password_id> | remove <password_id>")
+		fmt.Println("-tools and -hosts are comma separated, for example -tools tools/send_email -hosts smtp.example.com:587")
+		fmt.Printf("Key is taken from %s, %s or passphrase(%s or terminal).\n", Passwords_key_env, Passwords_key_file_env, Passwords_passphrase_env)
+		return 2
+	}
+	if len(args) == 0 {
+		return usage()
+	}
+
+	//scopes
+	fset := flag.NewFlagSet("vault "+args[0], flag.ContinueOnError)
+	tools := fset.String("tools", "", "Tool folders(filepath.Match patterns), which can read the password. Empty = all tools.")
+	hosts := fset.String("hosts", "", "Hosts, where the password can be sent. Empty = all hosts.")
+	if fset.Parse(args[1:]) != nil {
+		return 2
+	}
+	args = append(args[:1], fset.Args()...)
+	for _, pattern := range _passwords_splitList(*tools) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			fmt.Printf("Error: invalid -tools pattern '%s': %v\n", pattern, err)
+			return 2
+		}
+	}
+
+	rp, err := NewPasswords("passwords.vault", "passwords.json")
+	if err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	defer rp.Destroy()
+
+	switch {
+	case args[0] == "add" && len(args) == 1:
+		var password []byte
+		password, err = _passwords_readSecret("Password: ")
+		if err == nil && len(password) == 0 {
+			err = fmt.Errorf("empty password")
+		}
+		if err == nil && len(password) < Redact_min_secret_len {
+			fmt.Printf("Warning: password is shorter than %d characters, it won't be masked in tool results, console and sessions\n", Redact_min_secret_len)
+		}
+		if err == nil {
+			var id string
+			id, err = rp.Add(Passwords_secret{Password: string(password), Tools: _passwords_splitList(*tools), Hosts: _passwords_splitList(*hosts)})
+			if err == nil {
+				fmt.Println("password_id:", id)
+			}
+		}
+
+	case args[0] == "list" && len(args) == 1:
+		for _, id := range rp.Ids() {
+			secret, _ := rp.Find(id)
+			fmt.Printf("%s tools: %s hosts: %s\n", id, _passwords_joinList(secret.Tools), _passwords_joinList(secret.Hosts))
+		}
+
+	case args[0] == "rotate" && len(args) == 2:
+		var password []byte
+		password, err = _passwords_readSecret("New password: ")
+		if err == nil && len(password) == 0 {
+			err = fmt.Errorf("empty password")
+		}
+		if err == nil && len(password) < Redact_min_secret_len {
+			fmt.Printf("Warning: password is shorter than %d characters, it won't be masked in tool results, console and sessions\n", Redact_min_secret_len)
+		}
+		if err == nil {
+			err = rp.Rotate(args[1], string(password))
+		}
+
+	case args[0] == "scope" && len(args) == 2:
+		err = rp.SetScope(args[1], _passwords_splitList(*tools), _passwords_splitList(*hosts))
+
+	case args[0] == "remove" && len(args) == 2:
+		err = rp.Remove(args[1])
+
+	default:
+		return usage()
+	}
+
+	if err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	return 0
+}
+
+func _passwords_splitList(str string) []string {
+	var list []string
+	for _, it := range strings.Split(str, ",") {
+		it = strings.TrimSpace(it)
+		if it != "" {
+			list = append(list, it)
+		}
+	}
+	return list
+}
+
+func _passwords_joinList(list []string) string {
+	if len(list) == 0 {
+		return "*"
+	}
+	return strings.Join(list, ",")
 }
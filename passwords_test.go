@@ -0,0 +1,34 @@
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestPasswordsRemoveApproved(t *testing.T) {
+	rp := &Passwords{approved: map[string]bool{}}
+	rp.SetApproved("tools/a", "db")
+	rp.SetApproved("tools/a", "mail")
+	rp.SetApproved("tools/ab", "db")
+
+	rp.RemoveApproved("tools/a")
+	if rp.IsApproved("tools/a", "db") || rp.IsApproved("tools/a", "mail") {
+		t.Error("approval of changed tool was kept")
+	}
+	if !rp.IsApproved("tools/ab", "db") {
+		t.Error("approval of other tool was removed")
+	}
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/*
+Host <-> tool protocol. Tool side is in tools/sdk.go and must be kept in sync.
+
+Every message is one frame(all integers are little-endian uint64):
+
+	[type][request_id][payload_size][payload]
+
+Payload is JSON of the Protocol_* structure which belongs to the type.
+
+Conversation:
+ 1. tool -> host: Protocol_hello{Version, Token}. Token is from SKY_AGENT_TOOL_TOKEN env variable.
+ 2. host -> tool: Protocol_hello{Version} with version which will be used, or Protocol_error and connection is closed.
+ 3. host -> tool: Protocol_input{Arguments, Fs_policy, Net_policy}
+ 4. tool -> host: any number of requests(RunAgent, SetToolCode, Sandbox_violation, GetPassword). Every request has new request_id and host answers with
+    Protocol_type_reply(same request_id) or Protocol_type_error.
+ 5. tool -> host: Protocol_result and tool exits.
+*/
+
+const Protocol_version = 3
+
+// frame types
+const (
+	Protocol_type_result            = 1 //tool -> host: Protocol_result
+	Protocol_type_run_agent         = 2 //tool -> host: Protocol_runAgent, reply: Protocol_runAgent_reply
+	Protocol_type_set_tool_code     = 3 //tool -> host: Protocol_setToolCode, reply: Protocol_setToolCode_reply or compiler error
+	Protocol_type_sandbox_violation = 4 //tool -> host: Protocol_sandboxViolation, reply: Protocol_sandboxViolation_reply
+	Protocol_type_get_password      = 5 //tool -> host: Protocol_getPassword, reply: Protocol_getPassword_reply or error when id is unknown
+	Protocol_type_hello             = 6 //both ways: Protocol_hello
+	Protocol_type_input             = 7 //host -> tool: Protocol_input
+	Protocol_type_reply             = 8 //host -> tool: Protocol_*_reply
+	Protocol_type_error             = 9 //both ways: Protocol_error
+)
+
+const Protocol_max_payload = 256 * 1024 * 1024
+
+var Protocol_ErrPayloadLimit = errors.New("frame payload is over limit")
+
+type Protocol_frame struct {
+	Type       uint64
+	Request_id uint64
+	Payload    []byte
+}
+
+type Protocol_hello struct {
+	Version int
+	Token   string `json:",omitempty"`
+}
+type Protocol_input struct {
+	Arguments  string //JSON from LLM
+	Fs_policy  Protocol_fsPolicy
+	Net_policy Protocol_netPolicy
+}
+type Protocol_fsPolicy struct {
+	Root  string   //working directory, Deny patterns are relative to it
+	Read  []string //absolute, symlinks resolved
+	Write []string //absolute, symlinks resolved
+	Deny  []string
+}
+type Protocol_netPolicy struct {
+	Mode  string //Sandbox_net_*
+	Allow []string
+}
+type Protocol_result struct {
+	Result json.RawMessage
+}
+type Protocol_error struct {
+	Message string
+}
+
+type Protocol_runAgent struct {
+	Use_case      string
+	Max_iters     int
+	Max_tokens    int
+	System_prompt string
+	User_prompt   string
+}
+type Protocol_runAgent_reply struct {
+	Answer string
+}
+
+type Protocol_setToolCode struct {
+	Tool_name string
+	Code      string
+}
+type Protocol_setToolCode_reply struct {
+	//compiler error is sent as Protocol_error
+}
+
+type Protocol_sandboxViolation struct {
+	Info string
+}
+type Protocol_sandboxViolation_reply struct {
+	Block bool
+}
+
+type Protocol_getPassword struct {
+	Id string
+}
+type Protocol_getPassword_reply struct {
+	Password string
+}
+
+// Payload over max_payload is not read and error is returned.
+func Protocol_readFrame(rd io.Reader, max_payload uint64) (Protocol_frame, error) {
+	var header [24]byte
+	_, err := io.ReadFull(rd, header[:])
+	if err != nil {
+		return Protocol_frame{}, err
+	}
+
+	frame := Protocol_frame{
+		Type:       binary.LittleEndian.Uint64(header[0:]),
+		Request_id: binary.LittleEndian.Uint64(header[8:]),
+	}
+	size := binary.LittleEndian.Uint64(header[16:])
+	if size > max_payload {
+		return Protocol_frame{}, fmt.Errorf("%w(%d > %d bytes)", Protocol_ErrPayloadLimit, size, max_payload)
+	}
+
+	frame.Payload = make([]byte, size)
+	_, err = io.ReadFull(rd, frame.Payload)
+	if err != nil {
+		return Protocol_frame{}, err
+	}
+	return frame, nil
+}
+
+// payload is converted into JSON.
+func Protocol_writeFrame(wr io.Writer, tp uint64, request_id uint64, payload interface{}) error {
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	//one Write() for whole frame
+	buff := make([]byte, 24, 24+len(js))
+	binary.LittleEndian.PutUint64(buff[0:], tp)
+	binary.LittleEndian.PutUint64(buff[8:], request_id)
+	binary.LittleEndian.PutUint64(buff[16:], uint64(len(js)))
+	buff = append(buff, js...)
+
+	_, err = wr.Write(buff)
+	return err
+}
+
+// Checks the type and converts payload from JSON.
+func (frame *Protocol_frame) Decode(tp uint64, payload interface{}) error {
+	if frame.Type == Protocol_type_error && tp != Protocol_type_error {
+		var perr Protocol_error
+		json.Unmarshal(frame.Payload, &perr)
+		return fmt.Errorf("%s", perr.Message)
+	}
+	if frame.Type != tp {
+		return fmt.Errorf("expected frame type %d, received %d", tp, frame.Type)
+	}
+
+	err := json.Unmarshal(frame.Payload, payload)
+	if err != nil {
+		return fmt.Errorf("frame type %d has invalid payload: %w", frame.Type, err)
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProtocolFrames(t *testing.T) {
+	tests := []struct {
+		name    string
+		tp      uint64
+		payload interface{}
+	}{
+		{"hello", Protocol_type_hello, &Protocol_hello{Version: Protocol_version, Token: "abc"}},
+		{"input", Protocol_type_input, &Protocol_input{Arguments: `{"a":1}`, Fs_policy: Protocol_fsPolicy{Root: "/r", Read: []string{"/r"}, Write: []string{"/r/disk"}, Deny: []string{"tools/**/bin"}}, Net_policy: Protocol_netPolicy{Mode: "allow", Allow: []string{"example.com"}}}},
+		{"result", Protocol_type_result, &Protocol_result{Result: json.RawMessage(`"done"`)}},
+		{"run agent", Protocol_type_run_agent, &Protocol_runAgent{Use_case: "agent", Max_iters: 20, Max_tokens: 20000, System_prompt: "s", User_prompt: "u"}},
+		{"set tool code", Protocol_type_set_tool_code, &Protocol_setToolCode{Tool_name: "t", Code: "package main"}},
+		{"sandbox violation", Protocol_type_sandbox_violation, &Protocol_sandboxViolation{Info: "write /etc"}},
+		{"get password", Protocol_type_get_password, &Protocol_getPassword{Id: "mail"}},
+		{"reply", Protocol_type_reply, &Protocol_getPassword_reply{Password: "x"}},
+		{"error", Protocol_type_error, &Protocol_error{Message: "failed"}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, tool := net.Pipe()
+			defer host.Close()
+			defer tool.Close()
+
+			request_id := uint64(i + 1)
+			go Protocol_writeFrame(tool, tt.tp, request_id, tt.payload)
+			frame, err := Protocol_readFrame(host, Protocol_max_payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if frame.Request_id != request_id {
+				t.Fatalf("expected request_id %d, got %d", request_id, frame.Request_id)
+			}
+
+			out := reflect.New(reflect.TypeOf(tt.payload).Elem()).Interface()
+			err = frame.Decode(tt.tp, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(out, tt.payload) {
+				t.Fatalf("expected %+v, got %+v", tt.payload, out)
+			}
+		})
+	}
+}
+
+func TestProtocolDecode(t *testing.T) {
+	js, _ := json.Marshal(Protocol_error{Message: "compiler failed"})
+	frame := Protocol_frame{Type: Protocol_type_error, Request_id: 1, Payload: js}
+	var reply Protocol_setToolCode_reply
+	err := frame.Decode(Protocol_type_reply, &reply)
+	if err == nil || err.Error() != "compiler failed" {
+		t.Fatalf("expected error frame message, got %v", err)
+	}
+
+	frame = Protocol_frame{Type: Protocol_type_result, Payload: []byte("{}")}
+	err = frame.Decode(Protocol_type_reply, &reply)
+	if err == nil || !strings.Contains(err.Error(), "expected frame type") {
+		t.Fatalf("expected type mismatch, got %v", err)
+	}
+
+	frame = Protocol_frame{Type: Protocol_type_reply, Payload: []byte("{")}
+	err = frame.Decode(Protocol_type_reply, &reply)
+	if err == nil || !strings.Contains(err.Error(), "invalid payload") {
+		t.Fatalf("expected invalid payload, got %v", err)
+	}
+}
+
+func TestProtocolPayloadLimit(t *testing.T) {
+	host, tool := net.Pipe()
+	defer host.Close()
+	defer tool.Close()
+
+	//only header is sent, payload must not be read or allocated
+	go func() {
+		var header [24]byte
+		binary.LittleEndian.PutUint64(header[0:], Protocol_type_result)
+		binary.LittleEndian.PutUint64(header[16:], Protocol_max_payload+1)
+		tool.Write(header[:])
+	}()
+	_, err := Protocol_readFrame(host, Protocol_max_payload)
+	if !errors.Is(err, Protocol_ErrPayloadLimit) {
+		t.Fatalf("expected Protocol_ErrPayloadLimit, got %v", err)
+	}
+}
+
+func TestProtocolHello(t *testing.T) {
+	tests := []struct {
+		name    string
+		tp      uint64
+		hello   Protocol_hello
+		wantErr string //"" = accepted
+	}{
+		{"ok", Protocol_type_hello, Protocol_hello{Version: Protocol_version}, ""},
+		{"bad version", Protocol_type_hello, Protocol_hello{Version: Protocol_version - 1}, "unsupported protocol version"},
+		{"bad token", Protocol_type_hello, Protocol_hello{Version: Protocol_version, Token: "123"}, "invalid token"},
+		{"not hello", Protocol_type_result, Protocol_hello{Version: Protocol_version}, "expected frame type"},
+		{"oversized hello", Protocol_type_hello, Protocol_hello{Version: Protocol_version, Token: strings.Repeat("x", 2000)}, "closed"}, //host closes connection without reply
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &NetServer{calls: make(map[string]*NetServerCall)}
+			call, err := server.NewCall()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.hello.Token == "" {
+				tt.hello.Token = call.Token
+			}
+
+			host, tool := net.Pipe()
+			defer tool.Close()
+			go server.route(&NerServerClient{conn: host})
+
+			tool.SetDeadline(time.Now().Add(5 * time.Second))
+			go Protocol_writeFrame(tool, tt.tp, 7, tt.hello)
+			frame, err := Protocol_readFrame(tool, Protocol_max_payload)
+			if err == nil {
+				if frame.Request_id != 7 {
+					t.Fatalf("reply has request_id %d, expected 7", frame.Request_id)
+				}
+				var reply Protocol_hello
+				err = frame.Decode(Protocol_type_hello, &reply)
+				if err == nil && reply.Version != Protocol_version {
+					t.Fatalf("host replied with version %d", reply.Version)
+				}
+			}
+
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				select {
+				case cl := <-call.conn:
+					cl.Destroy()
+				case <-time.After(5 * time.Second):
+					t.Fatal("connection was not passed to call")
+				}
+				return
+			}
+			if err == nil || (tt.wantErr != "closed" && !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("expected error '%s', got %v", tt.wantErr, err)
+			}
+			if len(call.conn) > 0 {
+				t.Fatal("rejected connection was passed to call")
+			}
+		})
+	}
+}
+
+// tools/sdk.go is compiled with test which runs SDK client against host's frames.
+func TestProtocolSDK(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds SDK")
+	}
+
+	dir := t.TempDir()
+	sdk, err := os.ReadFile("tools/sdk.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sandbox, err := os.ReadFile("tools/sdk_sandbox.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"go.mod":     "module sdk_conformance\n\ngo 1.23\n",
+		"main.go":    strings.Replace(string(sdk), "_replace_with_tool_structure_", "conformance", 1),
+		"sandbox.go": string(sandbox),
+		"tool.go":    "package main\n\ntype conformance struct{}\n\nfunc (st *conformance) run() string {\n\treturn \"\"\n}\n",
+		"sdk_test.go": strings.NewReplacer(
+			"PROTOCOL_VERSION", strconv.Itoa(Protocol_version),
+			"PROTOCOL_TYPES", fmt.Sprint(Protocol_type_result, ",", Protocol_type_run_agent, ",", Protocol_type_set_tool_code, ",", Protocol_type_sandbox_violation, ",", Protocol_type_get_password, ",",
+				Protocol_type_hello, ",", Protocol_type_input, ",", Protocol_type_reply, ",", Protocol_type_error)).Replace(g_protocol_sdk_test),
+	}
+	for name, data := range files {
+		err = os.WriteFile(filepath.Join(dir, name), []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmd := exec.Command("go", "test", "-count=1", ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "CGO_ENABLED=0")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+}
+
+// Host side is written with raw frames, so it doesn't depend on sky_agent package. Constants must match protocol.go.
+const g_protocol_sdk_test = `package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func hostWrite(conn net.Conn, tp uint64, request_id uint64, payload interface{}) {
+	js, _ := json.Marshal(payload)
+	data := make([]byte, 24, 24+len(js))
+	binary.LittleEndian.PutUint64(data[0:], tp)
+	binary.LittleEndian.PutUint64(data[8:], request_id)
+	binary.LittleEndian.PutUint64(data[16:], uint64(len(js)))
+	conn.Write(append(data, js...))
+}
+
+// Reads request and answers it with (tp, request_id + id_shift, reply).
+func hostAnswer(conn net.Conn, tp uint64, id_shift uint64, reply interface{}) {
+	var header [24]byte
+	io.ReadFull(conn, header[:])
+	data := make([]byte, binary.LittleEndian.Uint64(header[16:]))
+	io.ReadFull(conn, data)
+	hostWrite(conn, tp, binary.LittleEndian.Uint64(header[8:])+id_shift, reply)
+}
+
+func newClient(t *testing.T) (*SDK_NetClient, net.Conn) {
+	host, tool := net.Pipe()
+	t.Cleanup(func() { host.Close(); tool.Close() })
+	return &SDK_NetClient{conn: tool}, host
+}
+
+func TestConstants(t *testing.T) {
+	if _sdk_protocol_version != PROTOCOL_VERSION {
+		t.Fatalf("SDK protocol version %d, host %d", _sdk_protocol_version, PROTOCOL_VERSION)
+	}
+	sdk := []uint64{_sdk_type_result, _sdk_type_run_agent, _sdk_type_set_tool_code, _sdk_type_sandbox_violation, _sdk_type_get_password, _sdk_type_hello, _sdk_type_input, _sdk_type_reply, _sdk_type_error}
+	host := []uint64{PROTOCOL_TYPES}
+	for i := range host {
+		if sdk[i] != host[i] {
+			t.Fatalf("frame type %d: SDK %d, host %d", i, sdk[i], host[i])
+		}
+	}
+}
+
+func TestHello(t *testing.T) {
+	client, host := newClient(t)
+	go hostAnswer(host, _sdk_type_hello, 0, _sdk_hello{Version: _sdk_protocol_version})
+	if err := client.Hello("token"); err != nil {
+		t.Fatal(err)
+	}
+
+	client, host = newClient(t)
+	go hostAnswer(host, _sdk_type_hello, 0, _sdk_hello{Version: _sdk_protocol_version + 1})
+	if err := client.Hello("token"); err == nil || !strings.Contains(err.Error(), "protocol version") {
+		t.Fatalf("expected version error, got %v", err)
+	}
+}
+
+func TestCall(t *testing.T) {
+	client, host := newClient(t)
+	go hostAnswer(host, _sdk_type_reply, 0, map[string]string{"Password": "secret"})
+	var reply struct{ Password string }
+	if err := client.Call(_sdk_type_get_password, _sdk_getPassword{Id: "mail"}, &reply); err != nil || reply.Password != "secret" {
+		t.Fatalf("got %v, %+v", err, reply)
+	}
+}
+
+func TestErrorFrame(t *testing.T) {
+	client, host := newClient(t)
+	go hostAnswer(host, _sdk_type_error, 0, _sdk_error{Message: "unknown password"})
+	var reply struct{ Password string }
+	if err := client.Call(_sdk_type_get_password, _sdk_getPassword{Id: "mail"}, &reply); err == nil || err.Error() != "unknown password" {
+		t.Fatalf("expected host's error, got %v", err)
+	}
+}
+
+func TestRequestIdMismatch(t *testing.T) {
+	client, host := newClient(t)
+	go hostAnswer(host, _sdk_type_reply, 1, map[string]string{})
+	var reply struct{}
+	if err := client.Call(_sdk_type_set_tool_code, _sdk_setToolCode{}, &reply); err == nil || !strings.Contains(err.Error(), "expected reply for request") {
+		t.Fatalf("expected request_id error, got %v", err)
+	}
+}
+
+func TestInput(t *testing.T) {
+	client, host := newClient(t)
+	go hostWrite(host, _sdk_type_input, 0, map[string]interface{}{"Arguments": "{}", "Fs_policy": map[string]interface{}{"Root": "/r", "Deny": []string{"x"}}, "Net_policy": map[string]interface{}{"Mode": "none"}})
+	var input _sdk_input
+	if err := client.ReadFrame(_sdk_type_input, 0, &input); err != nil || input.Fs_policy.Root != "/r" || input.Net_policy.Mode != "none" {
+		t.Fatalf("got %v, %+v", err, input)
+	}
+}
+`
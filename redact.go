@@ -0,0 +1,297 @@
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const Redact_mask = "[REDACTED]"
+
+// Used when redact_patterns.txt doesn't exist.
+var g_redact_patterns = []string{
+	`sk-[A-Za-z0-9_-]{20,}`,                 //OpenAI, Anthropic
+	`xai-[A-Za-z0-9]{20,}`,                  //xAI
+	`gsk_[A-Za-z0-9]{20,}`,                  //Groq
+	`pplx-[A-Za-z0-9]{20,}`,                 //Perplexity
+	`AIza[0-9A-Za-z_-]{35}`,                 //Google
+	`AKIA[0-9A-Z]{16}`,                      //AWS access key id
+	`gh[pousr]_[A-Za-z0-9]{36,}`,            //GitHub
+	`github_pat_[A-Za-z0-9_]{22,}`,          //GitHub
+	`xox[abposr]-[A-Za-z0-9-]{10,}`,         //Slack
+	`(?i)bearer\s+[A-Za-z0-9._~+/-]{16,}=*`, //Authorization header
+	`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`,
+}
+
+// Passwords shorter than this are not masked, because they would mask common words.
+const Redact_min_secret_len = 8
+
+// RedactorStream holds back at least this many bytes, so secret split between chunks is masked whole.
+const Redact_stream_hold = 128
+
+// Masks secrets in text, which leaves the agent: tool results(they go to LLM), console and session files.
+type Redactor struct {
+	passwords *Passwords
+	patterns  []*regexp.Regexp
+}
+
+func NewRedactor(passwords *Passwords, patterns []string) (*Redactor, error) {
+	rd := &Redactor{passwords: passwords}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern '%s': %w", pattern, err)
+		}
+		rd.patterns = append(rd.patterns, re)
+	}
+	return rd, nil
+}
+
+// Reads one regexp per line, '#' starts comment line. Missing file = g_redact_patterns.
+func LoadRedactPatterns(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return g_redact_patterns, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		ln := strings.TrimSpace(sc.Text())
+		if ln == "" || strings.HasPrefix(ln, "#") {
+			continue
+		}
+		patterns = append(patterns, ln)
+	}
+	return patterns, sc.Err()
+}
+
+// Tool results are often JSON, so secrets are searched in JSON-escaped form too.
+func (rd *Redactor) String(str string) string {
+	if rd == nil || str == "" {
+		return str
+	}
+	return _redact_mask(str, rd.ranges(str))
+}
+
+// Masks secrets inside JSON string values, for example saved session. Keys, numbers and formatting are kept, so JSON stays valid.
+func (rd *Redactor) JSON(js []byte) []byte {
+	if rd == nil {
+		return js
+	}
+
+	out := make([]byte, 0, len(js))
+	for i := 0; i < len(js); i++ {
+		if js[i] != '"' {
+			out = append(out, js[i])
+			continue
+		}
+
+		//find end of string
+		end := i + 1
+		for end < len(js) && js[end] != '"' {
+			if js[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(js) {
+			return append(out, js[i:]...) //invalid JSON
+		}
+		lit := js[i : end+1]
+		i = end
+
+		//keys are not changed
+		next := end + 1
+		for next < len(js) && strings.ContainsRune(" \t\r\n", rune(js[next])) {
+			next++
+		}
+		var value string
+		if (next < len(js) && js[next] == ':') || json.Unmarshal(lit, &value) != nil {
+			out = append(out, lit...)
+			continue
+		}
+
+		redacted := rd.String(value)
+		if redacted == value {
+			out = append(out, lit...) //keep original escaping
+			continue
+		}
+		lit2, err := json.Marshal(redacted)
+		if err != nil {
+			lit2 = []byte(`"` + Redact_mask + `"`)
+		}
+		out = append(out, lit2...)
+	}
+	return out
+}
+
+// Byte ranges of secrets and patterns in str, sorted and merged.
+func (rd *Redactor) ranges(str string) [][2]int {
+	var ranges [][2]int
+	add := func(needle string) {
+		for start := 0; ; {
+			i := strings.Index(str[start:], needle)
+			if i < 0 {
+				return
+			}
+			ranges = append(ranges, [2]int{start + i, start + i + len(needle)})
+			start += i + len(needle)
+		}
+	}
+	for _, secret := range rd.secrets() {
+		add(secret)
+		escaped, err := json.Marshal(secret)
+		if err == nil && string(escaped[1:len(escaped)-1]) != secret {
+			add(string(escaped[1 : len(escaped)-1]))
+		}
+	}
+	for _, re := range rd.patterns {
+		for _, loc := range re.FindAllStringIndex(str, -1) {
+			ranges = append(ranges, [2]int{loc[0], loc[1]})
+		}
+	}
+
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	var merged [][2]int
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r[0] <= merged[n-1][1] {
+			merged[n-1][1] = max(merged[n-1][1], r[1])
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+func _redact_mask(str string, ranges [][2]int) string {
+	if len(ranges) == 0 {
+		return str
+	}
+	var sb strings.Builder
+	last := 0
+	for _, r := range ranges {
+		sb.WriteString(str[last:r[0]])
+		sb.WriteString(Redact_mask)
+		last = r[1]
+	}
+	sb.WriteString(str[last:])
+	return sb.String()
+}
+
+// Masks text which comes in chunks(LLM streaming). End of text is held back until it can't be a part of secret.
+type RedactorStream struct {
+	rd      *Redactor
+	pending string
+}
+
+func NewRedactorStream(rd *Redactor) *RedactorStream {
+	return &RedactorStream{rd: rd}
+}
+
+// Returns masked text, which can be printed. It can be "".
+func (st *RedactorStream) Write(chunk string) string {
+	if st.rd == nil {
+		return chunk
+	}
+	st.pending += chunk
+
+	hold := Redact_stream_hold
+	if secrets := st.rd.secrets(); len(secrets) > 0 {
+		hold = max(hold, len(secrets[0])*6) //JSON escaped
+	}
+	if len(st.pending) <= hold {
+		return ""
+	}
+
+	//cut at white space, so word which can grow into secret is not split
+	cut := strings.LastIndexAny(st.pending[:len(st.pending)-hold], " \t\r\n") + 1
+
+	//private key is masked, when its END arrives
+	ranges := st.rd.ranges(st.pending)
+	for start := 0; start < cut; {
+		i := strings.Index(st.pending[start:cut], "-----BEGIN ")
+		if i < 0 {
+			break
+		}
+		i += start
+		if !slices.ContainsFunc(ranges, func(r [2]int) bool { return r[0] <= i && i < r[1] }) {
+			cut = i
+			break
+		}
+		start = i + 1
+	}
+
+	n := 0
+	for _, r := range ranges {
+		if r[0] >= cut {
+			break
+		}
+		if r[1] > cut {
+			cut = r[0] //secret crosses cut
+			break
+		}
+		n++
+	}
+	if cut <= 0 {
+		return ""
+	}
+
+	out := _redact_mask(st.pending[:cut], ranges[:n])
+	st.pending = st.pending[cut:]
+	return out
+}
+
+// Returns rest of the text. Stream can be used again.
+func (st *RedactorStream) Flush() string {
+	out := st.rd.String(st.pending)
+	st.pending = ""
+	return out
+}
+
+// Passwords and API keys of services. Longer first, so secret which contains other secret is masked whole.
+func (rd *Redactor) secrets() []string {
+	var secrets []string
+	if rd.passwords != nil {
+		secrets = rd.passwords.Values()
+	}
+	for _, service := range g_services {
+		if !strings.HasPrefix(service.Api_key, "<your_api_key>") {
+			secrets = append(secrets, service.Api_key)
+		}
+	}
+
+	out := secrets[:0]
+	for _, secret := range secrets {
+		if len(secret) >= Redact_min_secret_len {
+			out = append(out, secret)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return len(out[i]) > len(out[j]) })
+	return out
+}
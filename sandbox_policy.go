@@ -0,0 +1,236 @@
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SandboxNetPolicy.Mode
+const (
+	Sandbox_net_deny      = "deny"      //no connections(default)
+	Sandbox_net_loopback  = "loopback"  //only to localhost
+	Sandbox_net_allowlist = "allowlist" //only to hosts from Allow
+	Sandbox_net_all       = "all"
+)
+
+type SandboxNetPolicy struct {
+	Mode  string
+	Allow []string //"example.com"(any port), "example.com:443", "*.example.com"(subdomains), "1.2.3.4:80"
+}
+
+// Which folders can tool read and write and where it can connect. Paths are relative to working directory.
+type SandboxToolPolicy struct {
+	Read  []string          //readable roots
+	Write []string          //writable roots, they are readable too
+	Deny  []string          //filepath.Match() patterns, "**/" = any number of folders. Never readable or writable, even inside roots
+	Net   *SandboxNetPolicy //nil = Default's
+}
+
+// sandbox_policy.json
+type SandboxPolicy struct {
+	Default SandboxToolPolicy
+	Tools   map[string]SandboxToolPolicy //[tool folder, for example "tools/access_disk/read_file"]. Read/Write/Net replace Default's, Deny is added to Default's.
+}
+
+// Used when sandbox_policy.json doesn't exist.
+func NewSandboxPolicy() *SandboxPolicy {
+	return &SandboxPolicy{
+		Default: SandboxToolPolicy{
+			Read:  []string{"disk", "tools"},
+			Write: []string{"disk"}, //tools are changed only by host(SDK_SetToolCode), so tool can't replace other tool's bin
+			Deny: []string{
+				"passwords.json",
+				"passwords.vault*",
+				"sandbox_policy.json",
+				"approvals.json",
+				"redact_patterns.txt",
+				"models.json",        //can have API keys
+				"tools/**/tool.json", //risk and limits
+				"tools/**/bin",       //compiled tools
+				"tools/**/ini",       //time stamp, new one would skip compilation
+				"last.json",          //session
+				"[0-9]*.json",        //sessions
+				"tools/sdk.go",
+				"tools/sdk_sandbox.go",
+				"tools/sdk_sandbox_fns.txt",
+			},
+			Net: &SandboxNetPolicy{Mode: Sandbox_net_deny},
+		},
+	}
+}
+
+func LoadSandboxPolicy(path string) (*SandboxPolicy, error) {
+	js, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return NewSandboxPolicy(), nil
+		}
+		return nil, err
+	}
+
+	policy := &SandboxPolicy{}
+	err = json.Unmarshal(js, policy)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	err = policy.Default.check()
+	if err != nil {
+		return nil, fmt.Errorf("%s: Default: %w", path, err)
+	}
+	for tool, tp := range policy.Tools {
+		err = tp.check()
+		if err != nil {
+			return nil, fmt.Errorf("%s: tool '%s': %w", path, tool, err)
+		}
+	}
+	return policy, nil
+}
+
+func (tp *SandboxToolPolicy) check() error {
+	for _, pattern := range tp.Deny {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid Deny pattern '%s': %w", pattern, err)
+		}
+	}
+	if tp.Net != nil {
+		switch tp.Net.Mode {
+		case Sandbox_net_deny, Sandbox_net_loopback, Sandbox_net_allowlist, Sandbox_net_all:
+		default:
+			return fmt.Errorf("invalid Net.Mode '%s', use '%s', '%s', '%s' or '%s'", tp.Net.Mode, Sandbox_net_deny, Sandbox_net_loopback, Sandbox_net_allowlist, Sandbox_net_all)
+		}
+	}
+	return nil
+}
+
+// Returns network policy for the tool. Default is 'deny'.
+func (policy *SandboxPolicy) GetNet(tool string) Protocol_netPolicy {
+	net := policy.Default.Net
+	if tp, found := policy.Tools[filepath.ToSlash(filepath.Clean(tool))]; found && tp.Net != nil {
+		net = tp.Net
+	}
+	if net == nil {
+		return Protocol_netPolicy{Mode: Sandbox_net_deny}
+	}
+	return Protocol_netPolicy{Mode: net.Mode, Allow: net.Allow}
+}
+
+// Returns policy for the tool with absolute, symlink-resolved roots, which is sent to the tool.
+func (policy *SandboxPolicy) GetFs(tool string) (Protocol_fsPolicy, error) {
+	fs := policy.Default
+	if tp, found := policy.Tools[filepath.ToSlash(filepath.Clean(tool))]; found {
+		if tp.Read != nil {
+			fs.Read = tp.Read
+		}
+		if tp.Write != nil {
+			fs.Write = tp.Write
+		}
+		fs.Deny = append(append([]string{}, fs.Deny...), tp.Deny...)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return Protocol_fsPolicy{}, err
+	}
+	root, err := filepath.EvalSymlinks(wd)
+	if err != nil {
+		return Protocol_fsPolicy{}, err
+	}
+
+	out := Protocol_fsPolicy{Root: root, Deny: fs.Deny}
+	for _, path := range fs.Read {
+		out.Read = append(out.Read, _sandboxPolicy_resolve(root, path))
+	}
+	for _, path := range fs.Write {
+		out.Write = append(out.Write, _sandboxPolicy_resolve(root, path))
+	}
+	return out, nil
+}
+
+// filepath.Match(), but "**/" matches any number of folders. Same as _sandbox_match() in tools/sdk_sandbox.go.
+func SandboxPolicy_match(pattern string, rel string) bool {
+	before, after, found := strings.Cut(pattern, "**/")
+	if !found {
+		ok, _ := filepath.Match(pattern, rel)
+		return ok
+	}
+
+	parts := strings.Split(rel, "/")
+	for i := range parts {
+		if before != "" {
+			ok, _ := filepath.Match(strings.TrimSuffix(before, "/"), strings.Join(parts[:i], "/"))
+			if !ok {
+				continue
+			}
+		}
+		for j := i; j < len(parts); j++ {
+			if SandboxPolicy_match(after, strings.Join(parts[j:], "/")) {
+				return true
+			}
+		}
+		if before == "" {
+			break //all depths were checked
+		}
+	}
+	return false
+}
+
+// Returns existing paths under root, which match Deny pattern.
+func SandboxPolicy_glob(root string, pattern string) []string {
+	before, _, found := strings.Cut(pattern, "**/")
+	if !found {
+		matches, _ := filepath.Glob(filepath.Join(root, pattern))
+		return matches
+	}
+
+	//walk only folder before "**", for example tools/
+	start := root
+	if dir := strings.TrimSuffix(before, "/"); dir != "" && !strings.ContainsAny(dir, "*?[") {
+		start = filepath.Join(root, dir)
+	}
+	var matches []string
+	filepath.WalkDir(start, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err == nil && SandboxPolicy_match(pattern, filepath.ToSlash(rel)) {
+			matches = append(matches, path)
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	return matches
+}
+
+func _sandboxPolicy_resolve(root string, path string) string {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return filepath.Clean(path) //doesn't exist(yet)
+	}
+	return resolved
+}
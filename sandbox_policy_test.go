@@ -0,0 +1,78 @@
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSandboxPolicyMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		rel     string
+		want    bool
+	}{
+		{"tools/**/tool.json", "tools/a/tool.json", true},
+		{"tools/**/tool.json", "tools/a/b/c/tool.json", true},
+		{"tools/**/tool.json", "tools/tool.json", true},
+		{"tools/**/tool.json", "disk/a/tool.json", false},
+		{"tools/**/bin", "tools/a/b/bin", true},
+		{"tools/**/bin", "tools/a/bin2", false},
+		{"**/bin", "bin", true},
+		{"**/bin", "disk/x/bin", true},
+		{"tools/*/tool.json", "tools/a/b/tool.json", false},
+		{"passwords.vault*", "passwords.vault.tmp", true},
+		{"[0-9]*.json", "disk/1.json", false},
+	}
+	for _, tt := range tests {
+		if got := SandboxPolicy_match(tt.pattern, tt.rel); got != tt.want {
+			t.Errorf("SandboxPolicy_match(%q, %q) = %v, want %v", tt.pattern, tt.rel, got, tt.want)
+		}
+	}
+}
+
+func TestSandboxPolicyDefault(t *testing.T) {
+	policy := NewSandboxPolicy()
+	for _, rel := range []string{"tools/a/bin", "tools/a/b/c/bin", "tools/a/ini", "tools/a/b/c/tool.json", "passwords.vault"} {
+		denied := false
+		for _, pattern := range policy.Default.Deny {
+			denied = denied || SandboxPolicy_match(pattern, rel)
+		}
+		if !denied {
+			t.Errorf("%s is not denied", rel)
+		}
+	}
+	for _, dir := range policy.Default.Write {
+		if dir == "tools" {
+			t.Error("tools are writable")
+		}
+	}
+}
+
+func TestSandboxPolicyGlob(t *testing.T) {
+	root := t.TempDir()
+	for _, path := range []string{"tools/a/bin", "tools/a/b/bin", "disk/bin"} {
+		os.MkdirAll(filepath.Join(root, filepath.Dir(path)), 0755)
+		os.WriteFile(filepath.Join(root, path), nil, 0644)
+	}
+	matches := SandboxPolicy_glob(root, "tools/**/bin")
+	if len(matches) != 2 {
+		t.Fatalf("expected 2 matches, got %v", matches)
+	}
+}
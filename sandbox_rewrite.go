@@ -0,0 +1,276 @@
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Packages which tool can't import at all. It's here and not in sdk_sandbox_fns.txt, because tools/ folder is writable by tools.
+var g_sandbox_forbidden_packages = []string{
+	"C",
+	"unsafe",
+	"syscall",
+	"plugin",
+	"runtime/cgo",
+	"golang.org/x/sys/unix",
+	"golang.org/x/sys/windows",
+	"golang.org/x/sys/execabs",
+	"go/build",     //runs 'go' command
+	"net/http/cgi", //runs any command
+	"sky_agent",    //host's packages are not sandboxed
+}
+
+// Files which 'go build' compiles or links besides .go files. Assembly can make syscalls directly.
+var g_sandbox_forbidden_exts = []string{".s", ".S", ".sx", ".syso", ".c", ".cc", ".cpp", ".cxx", ".h", ".hh", ".hpp", ".hxx", ".m", ".f", ".F", ".for", ".f90", ".swig", ".swigcxx"}
+
+// SDK internals. Tool is compiled into the same package, so without this check it could switch off sandbox(_sandbox_fs.Deny = nil, _sandbox_net.Mode = "all").
+var g_sandbox_private_prefixes = []string{"_sandbox_", "_sdk_"}
+
+// Third-party modules are compiled without sandbox rewrite, so tools can import only standard library. Standard import paths don't have dot in the first element.
+func IsStandardPackage(impPath string) bool {
+	first, _, _ := strings.Cut(impPath, "/")
+	return !strings.Contains(first, ".") && first != "sky_agent"
+}
+
+// Line from sdk_sandbox_fns.txt: "<import path>.<name> <replacement>" or "<import path>.<type>.<method> -". Replacement "-" means that name can't be used at all.
+// Types are not known during rewrite, so method rules forbid every selector with that name.
+type SandboxRule struct {
+	Package string //import path
+	Type    string //"" = package-level name
+	Name    string
+	Replace string //"" = forbidden
+}
+
+// Rejects files in tool's folder, which are not Go sources, but 'go build' would use them.
+func CheckToolSources(tool string) error {
+	files, err := os.ReadDir(tool)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			continue //sub-tools are compiled separately
+		}
+		ext := filepath.Ext(file.Name())
+		for _, forbidden := range g_sandbox_forbidden_exts {
+			if ext == forbidden {
+				return fmt.Errorf("%s: '%s' files are forbidden in tools", filepath.Join(tool, file.Name()), ext)
+			}
+		}
+	}
+	return nil
+}
+
+func LoadSandboxRules(path string) ([]SandboxRule, error) {
+	fl, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []SandboxRule
+	for _, ln := range strings.Split(string(fl), "\n") {
+		ln = strings.TrimSpace(ln)
+		if ln == "" || strings.HasPrefix(ln, "#") {
+			continue //skip
+		}
+
+		items := strings.Fields(ln)
+		if len(items) != 2 {
+			return nil, fmt.Errorf("%s: invalid line '%s'", path, ln)
+		}
+
+		//names are after last '/', import path can have dots too(golang.org/...)
+		slash := strings.LastIndexByte(items[0], '/')
+		names := strings.Split(items[0][slash+1:], ".")
+		if len(names) < 2 || len(names) > 3 {
+			return nil, fmt.Errorf("%s: invalid line '%s': expected '<import path>.<name>' or '<import path>.<type>.<method>'", path, ln)
+		}
+
+		rule := SandboxRule{Package: items[0][:slash+1] + names[0], Name: names[len(names)-1], Replace: items[1]}
+		if len(names) == 3 {
+			rule.Type = names[1]
+			if rule.Replace != "-" {
+				return nil, fmt.Errorf("%s: invalid line '%s': method can't be replaced, only forbidden", path, ln)
+			}
+		}
+		if rule.Replace == "-" {
+			rule.Replace = ""
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Parses the code, rejects forbidden packages and replaces every use of sandboxed function(call, method value, alias import) with its replacement from sdk_sandbox_fns.txt.
+// Strings and comments are not touched. Error has compiler-like format "file:line:col: message".
+func ApplySandbox(filename string, code string) (string, error) {
+	rules, err := LoadSandboxRules("tools/sdk_sandbox_fns.txt")
+	if err != nil {
+		return "", err
+	}
+	return ApplySandboxRules(filename, code, rules)
+}
+
+func ApplySandboxRules(filename string, code string, rules []SandboxRule) (string, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filename, code, parser.ParseComments) //object resolution must be on, it's used to find shadowed imports
+	if err != nil {
+		return "", err
+	}
+
+	errorf := func(pos token.Pos, format string, args ...interface{}) error {
+		return fmt.Errorf("%s: %s", fset.Position(pos), fmt.Sprintf(format, args...))
+	}
+
+	rulePackages := make(map[string]bool)
+	packageNames := make(map[string]bool) //goimports would add import for them
+	for _, rule := range rules {
+		rulePackages[rule.Package] = true
+		packageNames[path.Base(rule.Package)] = true
+	}
+	for _, forbidden := range g_sandbox_forbidden_packages {
+		packageNames[path.Base(forbidden)] = true
+	}
+
+	//imports: local name -> import path
+	imports := make(map[string]string)
+	for _, imp := range file.Imports {
+		impPath, err := strconv.Unquote(imp.Path.Value)
+		if err != nil {
+			return "", errorf(imp.Pos(), "invalid import path %s", imp.Path.Value)
+		}
+
+		for _, forbidden := range g_sandbox_forbidden_packages {
+			if impPath == forbidden || strings.HasPrefix(impPath, forbidden+"/") {
+				return "", errorf(imp.Pos(), "package \"%s\" is forbidden in tools", impPath)
+			}
+		}
+		if !IsStandardPackage(impPath) {
+			return "", errorf(imp.Pos(), "package \"%s\" is forbidden in tools, only standard library can be imported", impPath)
+		}
+
+		name := path.Base(impPath)
+		if imp.Name != nil {
+			name = imp.Name.Name
+		}
+		switch name {
+		case "_":
+			//only init() is run
+		case ".":
+			if rulePackages[impPath] {
+				return "", errorf(imp.Pos(), "dot import of package \"%s\" is forbidden in tools", impPath)
+			}
+		default:
+			imports[name] = impPath
+		}
+	}
+
+	//linkname can reach any unexported function. It needs "unsafe" import, but compiler error would be confusing
+	for _, group := range file.Comments {
+		for _, cm := range group.List {
+			if strings.HasPrefix(cm.Text, "//go:linkname") || strings.HasPrefix(cm.Text, "//go:cgo_") {
+				return "", errorf(cm.Pos(), "directive '%s' is forbidden in tools", strings.Fields(cm.Text)[0])
+			}
+		}
+	}
+
+	ast.Inspect(file, func(n ast.Node) bool {
+		if err != nil {
+			return false
+		}
+		if id, ok := n.(*ast.Ident); ok {
+			for _, prefix := range g_sandbox_private_prefixes {
+				if strings.HasPrefix(id.Name, prefix) {
+					err = errorf(id.Pos(), "identifier '%s' is reserved for SDK", id.Name)
+					return false
+				}
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+
+	//find selectors
+	type Edit struct {
+		start, end int
+		text       string
+	}
+	var edits []Edit
+	ast.Inspect(file, func(n ast.Node) bool {
+		if err != nil {
+			return false
+		}
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+
+		id, ok := sel.X.(*ast.Ident)
+		if ok && id.Obj == nil { //local variable can shadow import
+			impPath, found := imports[id.Name]
+			if found {
+				for _, rule := range rules {
+					if rule.Type == "" && rule.Package == impPath && rule.Name == sel.Sel.Name {
+						if rule.Replace == "" {
+							err = errorf(sel.Pos(), "%s.%s is forbidden in tools", impPath, sel.Sel.Name)
+							return false
+						}
+						edits = append(edits, Edit{start: fset.Position(sel.Pos()).Offset, end: fset.Position(sel.End()).Offset, text: rule.Replace})
+						break
+					}
+				}
+				return false
+			}
+			if packageNames[id.Name] {
+				err = errorf(sel.Pos(), "package '%s' is used without import", id.Name)
+				return false
+			}
+		}
+
+		//method, value's type is not known
+		for _, rule := range rules {
+			if rule.Type != "" && rule.Name == sel.Sel.Name {
+				err = errorf(sel.Sel.Pos(), "method %s.%s.%s is forbidden in tools", rule.Package, rule.Type, rule.Name)
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+
+	//apply from the end, so offsets stay valid
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start > edits[j].start })
+	for _, e := range edits {
+		code = code[:e.start] + e.text + code[e.end:]
+	}
+
+	return code, nil
+}
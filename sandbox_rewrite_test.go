@@ -0,0 +1,226 @@
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestApplySandboxRules(t *testing.T) {
+	rules, err := LoadSandboxRules("tools/sdk_sandbox_fns.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		code    string
+		want    string //must be in output
+		wantErr string //must be in error
+	}{
+		{"call", "package main\nimport \"os\"\nfunc f(){ os.WriteFile(\"a\", nil, 0) }", "_os_WriteFile(", ""},
+		{"read", "package main\nimport \"os\"\nfunc f(){ os.ReadFile(\"a\") }", "_os_ReadFile(", ""},
+		{"string and comment", "package main\nimport \"os\"\nvar s = \"os.WriteFile\" // os.WriteFile\nfunc f(){ os.ReadFile(\"a\") }", "\"os.WriteFile\" // os.WriteFile", ""},
+		{"alias import", "package main\nimport o \"os\"\nfunc f(){ o.WriteFile(\"a\", nil, 0) }", "_os_WriteFile(", ""},
+		{"method value", "package main\nimport \"os\"\nvar f = os.RemoveAll", "var f = _os_RemoveAll", ""},
+		{"nested func", "package main\nimport \"os\"\nfunc f(){ g(func(){ os.Remove(\"x\") }) }\nfunc g(func()){}", "_os_Remove(\"x\")", ""},
+		{"ioutil", "package main\nimport \"io/ioutil\"\nfunc f(){ ioutil.WriteFile(\"a\", nil, 0) }", "_os_WriteFile(", ""},
+		{"exec alias", "package main\nimport e \"os/exec\"\nvar f = e.Command", "var f = _exec_Command", ""},
+		{"shadowed import", "package main\nimport \"os\"\ntype T struct{}\nfunc (T) WriteFile(){}\nfunc f(){ os := T{}; os.WriteFile() }", "os.WriteFile()", ""},
+
+		{"ServeFile", "package main\nimport \"net/http\"\nfunc f(w http.ResponseWriter, r *http.Request){ http.ServeFile(w, r, \"/etc/passwd\") }", "_http_ServeFile(w, r,", ""},
+		{"LoadX509KeyPair", "package main\nimport \"crypto/tls\"\nfunc f(){ tls.LoadX509KeyPair(\"/etc/ssl/a\", \"/etc/ssl/b\") }", "_tls_LoadX509KeyPair(", ""},
+		{"ParseFile", "package main\nimport (\"go/parser\"; \"go/token\")\nfunc f(){ parser.ParseFile(token.NewFileSet(), \"/etc/passwd\", nil, 0) }", "_parser_ParseFile(", ""},
+		{"ParseDir", "package main\nimport (\"go/parser\"; \"go/token\")\nfunc f(){ parser.ParseDir(token.NewFileSet(), \"/root\", nil, 0) }", "_parser_ParseDir(", ""},
+		{"elf", "package main\nimport \"debug/elf\"\nfunc f(){ elf.Open(\"/bin/sh\") }", "_elf_Open(", ""},
+
+		{"http.Dir", "package main\nimport \"net/http\"\nfunc f(){ http.Dir(\"/\").Open(\"etc/passwd\") }", "", "net/http.Dir is forbidden"},
+		{"FileServer", "package main\nimport \"net/http\"\nvar h = http.FileServer(http.Dir(\"/\"))", "", "net/http.Dir is forbidden"},
+		{"zip", "package main\nimport \"archive/zip\"\nfunc f(){ zip.OpenReader(\"/etc/a.zip\") }", "", "archive/zip.OpenReader is forbidden"},
+		{"text template", "package main\nimport \"text/template\"\nvar t = template.Must(template.ParseFiles(\"/etc/passwd\"))", "", "text/template.ParseFiles is forbidden"},
+		{"html template glob", "package main\nimport \"html/template\"\nvar t, _ = template.ParseGlob(\"/etc/*\")", "", "html/template.ParseGlob is forbidden"},
+		{"template method", "package main\nimport \"html/template\"\nvar t, _ = template.New(\"x\").ParseFiles(\"/etc/passwd\")", "", "ParseFiles is forbidden"},
+		{"template method in other file", "package main\nfunc f(){ t.ParseGlob(\"/etc/*\") }", "", "ParseGlob is forbidden"},
+		{"template method value", "package main\nimport \"text/template\"\nvar f = (*template.Template).ParseFiles", "", "ParseFiles is forbidden"},
+		{"macho", "package main\nimport \"debug/macho\"\nfunc f(){ macho.Open(\"/bin/sh\") }", "", "forbidden"},
+		{"go/build", "package main\nimport \"go/build\"\nvar _ = build.Default", "", "package \"go/build\" is forbidden"},
+		{"cgi", "package main\nimport \"net/http/cgi\"\nvar _ = cgi.Handler{Path: \"/bin/sh\"}", "", "package \"net/http/cgi\" is forbidden"},
+
+		{"syscall", "package main\nimport \"syscall\"\nfunc f(){ syscall.Exit(1) }", "", "package \"syscall\" is forbidden"},
+		{"unsafe", "package main\nimport _ \"unsafe\"", "", "forbidden"},
+		{"cgo", "package main\n// #include <stdio.h>\nimport \"C\"", "", "forbidden"},
+		{"x/sys/unix", "package main\nimport u \"golang.org/x/sys/unix\"\nvar _ = u.Exec", "", "forbidden"},
+		{"host package", "package main\nimport \"sky_agent/tools/x/lib\"\nvar _ = lib.F", "", "forbidden"},
+		{"third-party", "package main\nimport \"github.com/evil/fs\"\nvar _ = fs.Write", "", "only standard library"},
+		{"x/crypto", "package main\nimport \"golang.org/x/crypto/ssh\"\nvar _ = ssh.Dial", "", "only standard library"},
+		{"dot import", "package main\nimport . \"os\"\nfunc f(){ WriteFile(\"a\", nil, 0) }", "", "dot import"},
+		{"forbidden type", "package main\nimport \"os/exec\"\nfunc f(){ c := exec.Cmd{Path: \"/bin/sh\"}; c.Run() }", "", "os/exec.Cmd is forbidden"},
+		{"linkname", "package main\n//go:linkname x os.y\nvar x int", "", "go:linkname"},
+
+		//sandbox state is in the same package as tool
+		{"fs policy", "package main\nfunc run(){ _sandbox_fs.Deny = nil; _sandbox_fs.Write = []string{\"/\"} }", "", "'_sandbox_fs' is reserved"},
+		{"net policy", "package main\nfunc run(){ _sandbox_net.Mode = \"all\" }", "", "'_sandbox_net' is reserved"},
+		{"sandbox helper", "package main\nvar f = _sandbox_initNet", "", "reserved"},
+		{"sdk client", "package main\nfunc run(){ _sdk_client = nil }", "", "'_sdk_client' is reserved"},
+		{"sdk redeclared", "package main\ntype _sdk_fsPolicy struct{}", "", "reserved"},
+
+		//goimports would add these imports after sandbox
+		{"os without import", "package main\nfunc f(){ os.WriteFile(\"/etc/x\", nil, 0) }", "", "package 'os' is used without import"},
+		{"syscall without import", "package main\nfunc f(){ syscall.Exec(\"/bin/sh\", nil, nil) }", "", "package 'syscall' is used without import"},
+		{"exec without import", "package main\nfunc f(){ exec.Command(\"sh\").Run() }", "", "package 'exec' is used without import"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := ApplySandboxRules("tool.go", tt.code, rules)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error '%s', got %v\n%s", tt.wantErr, err, out)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(out, tt.want) {
+				t.Fatalf("expected '%s' in:\n%s", tt.want, out)
+			}
+		})
+	}
+}
+
+func TestLoadSandboxRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fns.txt")
+	os.WriteFile(path, []byte("os.ReadFile _os_ReadFile\ngolang.org/x/net/proxy.Dial -\ntext/template.Template.ParseFiles -\n"), 0644)
+	rules, err := LoadSandboxRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SandboxRule{
+		{Package: "os", Name: "ReadFile", Replace: "_os_ReadFile"},
+		{Package: "golang.org/x/net/proxy", Name: "Dial"},
+		{Package: "text/template", Type: "Template", Name: "ParseFiles"},
+	}
+	if len(rules) != len(want) {
+		t.Fatalf("got %v", rules)
+	}
+	for i := range want {
+		if rules[i] != want[i] {
+			t.Errorf("rule %d: got %+v, want %+v", i, rules[i], want[i])
+		}
+	}
+
+	//method can't be rewritten, types are not known
+	os.WriteFile(path, []byte("text/template.Template.ParseFiles _template_ParseFiles\n"), 0644)
+	if _, err := LoadSandboxRules(path); err == nil {
+		t.Error("method replacement was accepted")
+	}
+}
+
+func TestCheckToolSources(t *testing.T) {
+	for _, name := range []string{"evil.s", "evil.syso", "evil.c"} {
+		tool := t.TempDir()
+		os.WriteFile(filepath.Join(tool, "tool.go"), []byte("package main\n"), 0644)
+		os.WriteFile(filepath.Join(tool, name), nil, 0644)
+		if err := CheckToolSources(tool); err == nil {
+			t.Errorf("%s was accepted", name)
+		}
+	}
+
+	tool := t.TempDir()
+	os.WriteFile(filepath.Join(tool, "tool.go"), []byte("package main\n"), 0644)
+	os.WriteFile(filepath.Join(tool, "tool.json"), []byte("{}"), 0644)
+	if err := CheckToolSources(tool); err != nil {
+		t.Error(err)
+	}
+}
+
+// Code without imports: goimports adds them, sandbox must still see the calls.
+func TestCompileToolSandboxWithoutImports(t *testing.T) {
+	if _, err := exec.LookPath("goimports"); err != nil {
+		t.Skip("goimports is not installed")
+	}
+
+	tool := t.TempDir()
+	code := "package main\n\nfunc run() {\n\tos.WriteFile(\"/etc/x\", nil, 0)\n}\n"
+	os.WriteFile(filepath.Join(tool, "tool.go"), []byte(code), 0644)
+
+	err := _compileTool_goimports(tool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed, err := _compileTool_sandbox(tool, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Fatal("sandbox didn't change the code")
+	}
+	err = _compileTool_goimports(tool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = _compileTool_sandbox(tool, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, _ := os.ReadFile(filepath.Join(tool, "tool.go"))
+	if strings.Contains(string(out), "os.WriteFile") || !strings.Contains(string(out), "_os_WriteFile(") {
+		t.Fatalf("call was not sandboxed:\n%s", out)
+	}
+
+	//syscall is added by goimports and then rejected
+	os.WriteFile(filepath.Join(tool, "tool.go"), []byte("package main\n\nfunc run() {\n\tsyscall.Exec(\"/bin/sh\", nil, nil)\n}\n"), 0644)
+	err = _compileTool_goimports(tool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = _compileTool_sandbox(tool, false)
+	if err == nil || !strings.Contains(err.Error(), "forbidden") {
+		t.Fatalf("expected forbidden package, got %v", err)
+	}
+}
+
+// Packages which are not in standard library are compiled without sandbox.
+func TestCompileToolCheckDeps(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs go list")
+	}
+
+	mod := t.TempDir()
+	tool := filepath.Join(mod, "tool")
+	os.MkdirAll(filepath.Join(mod, "lib"), 0755)
+	os.MkdirAll(tool, 0755)
+	os.WriteFile(filepath.Join(mod, "go.mod"), []byte("module evil\n\ngo 1.23\n"), 0644)
+	os.WriteFile(filepath.Join(mod, "lib", "lib.go"), []byte("package lib\n\nimport \"os\"\n\nfunc F() { os.WriteFile(\"/tmp/x\", nil, 0644) }\n"), 0644)
+
+	os.WriteFile(filepath.Join(tool, "tool.go"), []byte("package main\n\nimport \"strings\"\n\nfunc main() { strings.ToLower(\"\") }\n"), 0644)
+	err := _compileTool_checkDeps(tool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.WriteFile(filepath.Join(tool, "tool.go"), []byte("package main\n\nimport \"evil/lib\"\n\nfunc main() { lib.F() }\n"), 0644)
+	err = _compileTool_checkDeps(tool)
+	if err == nil || !strings.Contains(err.Error(), "evil/lib") {
+		t.Fatalf("expected rejected package, got %v", err)
+	}
+}
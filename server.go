@@ -17,118 +17,242 @@ limitations under the License.
 package main
 
 import (
-	"encoding/binary"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
 )
 
 type NerServerClient struct {
-	conn net.Conn
+	conn        net.Conn
+	max_payload uint64 //0 = Protocol_max_payload
 }
 
 type NetServer struct {
-	port     int
+	port     int    //tcp only
+	sock_dir string //unix only, private folder with socket file
 	listener net.Listener
 	exiting  bool
+
+	//tool process connects and sends its token first, then connection is passed to callTool() which started it
+	lock  sync.Mutex
+	calls map[string]*NetServerCall //[token]
+}
+
+// One-time token, which tool gets in env variable. Connection without valid token is closed.
+type NetServerCall struct {
+	Token string
+	conn  chan *NerServerClient
+}
+
+const NetServer_token_env = "SKY_AGENT_TOOL_TOKEN"
+
+// Env variables, which tool process gets from host. Others(vault key, API keys, any SKY_AGENT_*) are not passed, tool could read them with os.Getenv().
+var g_tool_env_allow = []string{"PATH", "HOME", "USER", "LANG", "LC_ALL", "LC_CTYPE", "TZ", "TMPDIR", "TERM", "SSL_CERT_FILE", "SSL_CERT_DIR", "HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy"}
+
+// Returns minimal env for tool process with one-time token. token = "" is not added.
+func NewToolEnv(token string) []string {
+	var env []string
+	for _, name := range g_tool_env_allow {
+		if value, found := os.LookupEnv(name); found {
+			env = append(env, name+"="+value)
+		}
+	}
+	if token != "" {
+		env = append(env, NetServer_token_env+"="+token) //env is not visible to other users like argv
+	}
+	return env
 }
 
+// On Linux, server listens on Unix domain socket, which is accessible only by current user. Other systems(or when it fails) use TCP on 127.0.0.1, starting at 'port'.
 func NewNetServer(port int) *NetServer {
-	server := &NetServer{}
-
-	port_last := port + 1000
-	for port < port_last {
-		var err error
-		server.listener, err = net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
-		if err == nil {
-			break
+	server := &NetServer{calls: make(map[string]*NetServerCall)}
+
+	if runtime.GOOS == "linux" {
+		err := server.listenUnix()
+		if err != nil {
+			fmt.Println("Warning: Unix socket failed, using TCP:", err)
 		}
-		port++
 	}
-	if port == port_last {
-		log.Fatal(fmt.Errorf("can not Listen()"))
+
+	if server.listener == nil {
+		port_last := port + 1000
+		for port < port_last {
+			var err error
+			server.listener, err = net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+			if err == nil {
+				break
+			}
+			port++
+		}
+		if port == port_last {
+			log.Fatal(fmt.Errorf("can not Listen()"))
+		}
+		server.port = port
 	}
-	server.port = port
+
+	go server.acceptLoop()
 
 	//fmt.Printf("Server is running on port: %d\n", server.port)
 	return server
 }
 
+func (server *NetServer) listenUnix() error {
+	dir, err := os.MkdirTemp("", "sky_agent-")
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(dir, 0700) //only owner can connect
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	server.listener, err = net.Listen("unix", filepath.Join(dir, "tools.sock"))
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	server.sock_dir = dir
+	return nil
+}
+
 func (server *NetServer) Destroy() {
 	server.exiting = true
 	server.listener.Close()
+	if server.sock_dir != "" {
+		os.RemoveAll(server.sock_dir)
+	}
 	//fmt.Printf("Server port: %d closed\n", server.port)
 }
 
-func (server *NetServer) Accept() (*NerServerClient, error) {
-	conn, err := server.listener.Accept()
+// Returns argument for tool binary: socket path or port number.
+func (server *NetServer) GetAddr() string {
+	if server.sock_dir != "" {
+		return server.listener.Addr().String()
+	}
+	return strconv.Itoa(server.port)
+}
+
+// Registers new tool call. Token must be passed to the tool process.
+func (server *NetServer) NewCall() (*NetServerCall, error) {
+	tokenBytes := make([]byte, 32) //256bit
+	_, err := rand.Read(tokenBytes)
 	if err != nil {
-		if server.exiting {
-			return nil, nil
-		}
 		return nil, err
 	}
-	return &NerServerClient{conn: conn}, nil
+	call := &NetServerCall{Token: hex.EncodeToString(tokenBytes), conn: make(chan *NerServerClient, 1)}
+
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.calls[call.Token] = call
+	return call, nil
 }
 
-func (client *NerServerClient) Destroy() {
-	client.conn.Close()
+func (server *NetServer) CloseCall(call *NetServerCall) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	delete(server.calls, call.Token)
 }
 
-func (client *NerServerClient) ReadInt() (uint64, error) {
-	var sz [8]byte
-	_, err := client.conn.Read(sz[:])
-	if err != nil {
-		return 0, err
+// Waits until tool with call's token connects or ctx is done.
+func (server *NetServer) Accept(ctx context.Context, call *NetServerCall) (*NerServerClient, error) {
+	select {
+	case cl := <-call.conn:
+		return cl, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
+}
 
-	return binary.LittleEndian.Uint64(sz[:]), nil
+func (server *NetServer) acceptLoop() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			if server.exiting {
+				return
+			}
+			fmt.Println("Error: Accept():", err)
+			continue
+		}
+
+		go server.route(&NerServerClient{conn: conn})
+	}
 }
 
-func (client *NerServerClient) WriteInt(value uint64) error {
-	var val [8]byte
-	binary.LittleEndian.PutUint64(val[:], value)
-	_, err := client.conn.Write(val[:])
+func (server *NetServer) route(cl *NerServerClient) {
+	//first message is hello with token. It's small, so unknown client can't make us allocate big payload
+	cl.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	frame, err := Protocol_readFrame(cl.conn, 1024)
+	cl.conn.SetReadDeadline(time.Time{})
 	if err != nil {
-		return err
+		cl.Destroy()
+		return
 	}
 
-	return nil
-}
-
-func (client *NerServerClient) ReadArray() ([]byte, error) {
-	//recv size
-	size, err := client.ReadInt()
+	var hello Protocol_hello
+	err = frame.Decode(Protocol_type_hello, &hello)
+	if err == nil && hello.Version != Protocol_version {
+		err = fmt.Errorf("unsupported protocol version %d, host supports %d", hello.Version, Protocol_version)
+	}
 	if err != nil {
-		return nil, err
+		cl.WriteError(frame.Request_id, err)
+		cl.Destroy()
+		return
 	}
 
-	//recv data
-	data := make([]byte, size)
-	p := 0
-	for p < int(size) {
-		n, err := client.conn.Read(data[p:])
-		if err != nil {
-			return nil, err
-		}
-		p += n
+	//token can be used only once
+	server.lock.Lock()
+	call, found := server.calls[hello.Token]
+	if found {
+		delete(server.calls, call.Token)
 	}
+	server.lock.Unlock()
 
-	return data, nil
-}
+	if !found {
+		fmt.Println("Warning: connection with invalid token was rejected")
+		cl.WriteError(frame.Request_id, fmt.Errorf("invalid token"))
+		cl.Destroy()
+		return
+	}
 
-func (client *NerServerClient) WriteArray(data []byte) error {
-	//send size
-	err := client.WriteInt(uint64(len(data)))
+	err = cl.WriteFrame(Protocol_type_hello, frame.Request_id, Protocol_hello{Version: Protocol_version})
 	if err != nil {
-		return err
+		cl.Destroy()
+		return
 	}
 
-	//send data
-	_, err = client.conn.Write(data)
-	if err != nil {
-		return err
+	call.conn <- cl
+}
+
+func (client *NerServerClient) Destroy() {
+	client.conn.Close()
+}
+
+func (client *NerServerClient) ReadFrame() (Protocol_frame, error) {
+	if client.max_payload > 0 {
+		return Protocol_readFrame(client.conn, client.max_payload)
 	}
+	return Protocol_readFrame(client.conn, Protocol_max_payload)
+}
 
-	return nil
+func (client *NerServerClient) WriteFrame(tp uint64, request_id uint64, payload interface{}) error {
+	return Protocol_writeFrame(client.conn, tp, request_id, payload)
+}
+
+func (client *NerServerClient) WriteReply(request_id uint64, payload interface{}) error {
+	return client.WriteFrame(Protocol_type_reply, request_id, payload)
+}
+
+func (client *NerServerClient) WriteError(request_id uint64, err error) error {
+	return client.WriteFrame(Protocol_type_error, request_id, Protocol_error{Message: err.Error()})
 }
@@ -0,0 +1,46 @@
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewToolEnv(t *testing.T) {
+	t.Setenv(Passwords_key_env, "00")
+	t.Setenv(Passwords_passphrase_env, "secret")
+	t.Setenv(Service_envName("openai", "API_KEY"), "sk-test")
+	t.Setenv("PATH", "/usr/bin")
+
+	env := NewToolEnv("token123")
+	found_path := false
+	found_token := false
+	for _, e := range env {
+		switch {
+		case e == NetServer_token_env+"=token123":
+			found_token = true
+		case strings.HasPrefix(e, "SKY_AGENT_"):
+			t.Errorf("tool gets %s", e)
+		case e == "PATH=/usr/bin":
+			found_path = true
+		}
+	}
+	if !found_token || !found_path {
+		t.Errorf("token or PATH is missing: %v", env)
+	}
+}
@@ -0,0 +1,572 @@
+//go:build linux
+
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+/*
+Tool binary is not started directly. Host starts itself(/proc/self/exe) in new user, mount, pid, ipc, uts(and network, when tool can't use it) namespaces.
+This "init" process:
+ 1. builds new root on tmpfs: read-only system folders(/usr, /lib, /etc, ...), /dev nodes, /proc, empty /tmp,
+    read-only bind of the repository, overlays of writable folders(disk/) over it, and hides denied files.
+ 2. pivot_root into it.
+ 3. drops all capabilities, sets no_new_privs and seccomp filter.
+ 4. execs the tool binary(same pid, so limits and kill work as before).
+
+Tool's writes go into overlay's upper folder. After tool exits, host copies them into real folders, except tools/, denied files, symlinks and devices.
+*/
+
+const ToolIsolation_env = "SKY_AGENT_TOOL_ISOLATION"
+
+type ToolIsolationConfig struct {
+	New_root   string   //empty folder for tmpfs
+	Root       string   //repository, tool's working directory
+	Write      []string //overlays, lower is the real folder
+	Upper      string   //<index of Write>/upper and /work for overlays
+	Deny       []string //existing paths which are hidden
+	Socket_dir string   //host's Unix socket folder, "" = TCP
+	Bin        string
+	Args       []string
+	Probe      bool //only check if isolation works, don't exec
+}
+
+type ToolIsolation struct {
+	new_root string
+	upper    string
+	root     string
+	write    []string
+	deny     []string
+}
+
+var g_toolIsolation_once sync.Once
+var g_toolIsolation_err error
+
+// Checks(only once) if this system allows unprivileged namespaces.
+func ToolIsolation_available() bool {
+	g_toolIsolation_once.Do(func() {
+		g_toolIsolation_err = _toolIsolation_probe()
+		if g_toolIsolation_err != nil {
+			fmt.Printf("Warning: tool isolation is not available(%v), tools run without namespaces\n", g_toolIsolation_err)
+		}
+	})
+	return g_toolIsolation_err == nil
+}
+
+func _toolIsolation_probe() error {
+	if _seccomp_getArch() == nil {
+		return fmt.Errorf("seccomp filter is not implemented for %s", runtime.GOARCH)
+	}
+
+	root, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	//overlay in user namespace needs Linux 5.11+
+	write, err := os.MkdirTemp("", "sky_agent_probe_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(write)
+
+	cmd := exec.Command("true")
+	iso, err := NewToolIsolation(cmd, Protocol_fsPolicy{Root: root, Write: []string{write}}, Protocol_netPolicy{Mode: Sandbox_net_deny}, "")
+	if err != nil {
+		return err
+	}
+	defer iso.Destroy()
+	iso.setConfig(cmd, func(cfg *ToolIsolationConfig) { cfg.Probe = true })
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("%v %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// Changes cmd, so it starts isolation init instead of tool binary. Call Destroy() after cmd.Wait().
+func NewToolIsolation(cmd *exec.Cmd, fs Protocol_fsPolicy, net Protocol_netPolicy, server_addr string) (*ToolIsolation, error) {
+	new_root, err := os.MkdirTemp("", "sky_agent_root_")
+	if err != nil {
+		return nil, err
+	}
+	iso := &ToolIsolation{new_root: new_root, root: fs.Root, deny: fs.Deny}
+
+	//upper folders are created by host, so it owns tool's files
+	iso.upper, err = os.MkdirTemp("", "sky_agent_upper_")
+	if err != nil {
+		iso.Destroy()
+		return nil, err
+	}
+	for _, dir := range fs.Write {
+		if _, err := os.Stat(dir); err != nil {
+			continue //doesn't exist
+		}
+		if strings.ContainsAny(dir, ",:") {
+			iso.Destroy()
+			return nil, fmt.Errorf("writable folder '%s' can't be used in overlay", dir)
+		}
+		i := strconv.Itoa(len(iso.write))
+		for _, sub := range []string{"upper", "work"} {
+			err = os.MkdirAll(filepath.Join(iso.upper, i, sub), 0700)
+			if err != nil {
+				iso.Destroy()
+				return nil, err
+			}
+		}
+		iso.write = append(iso.write, dir)
+	}
+
+	cfg := ToolIsolationConfig{
+		New_root: new_root,
+		Root:     fs.Root,
+		Write:    iso.write,
+		Upper:    iso.upper,
+		Bin:      cmd.Path,
+		Args:     cmd.Args,
+	}
+	if !filepath.IsAbs(cfg.Bin) {
+		cfg.Bin = filepath.Join(fs.Root, cfg.Bin)
+	}
+	if filepath.IsAbs(server_addr) {
+		cfg.Socket_dir = filepath.Dir(server_addr)
+	}
+
+	//denied files which exist now
+	for _, pattern := range fs.Deny {
+		for _, path := range SandboxPolicy_glob(fs.Root, pattern) {
+			if path != cfg.Bin {
+				cfg.Deny = append(cfg.Deny, path) //tool's own bin must stay, it's executed
+			}
+		}
+	}
+
+	flags := uintptr(syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS)
+	if net.Mode == Sandbox_net_deny && (cfg.Socket_dir != "" || server_addr == "") {
+		flags |= syscall.CLONE_NEWNET //TCP connection to host would not work from new network namespace
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Cloneflags |= flags
+	cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+	cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+	cmd.SysProcAttr.GidMappingsEnableSetgroups = false
+	cmd.SysProcAttr.Pdeathsig = syscall.SIGKILL
+
+	cmd.Path = "/proc/self/exe"
+	cmd.Args = []string{"sky_agent_tool_init"}
+	if cmd.Env == nil {
+		cmd.Env = NewToolEnv("")
+	}
+	iso.setConfig(cmd, func(c *ToolIsolationConfig) { *c = cfg })
+
+	return iso, nil
+}
+
+func (iso *ToolIsolation) setConfig(cmd *exec.Cmd, fn func(cfg *ToolIsolationConfig)) {
+	var cfg ToolIsolationConfig
+	env := cmd.Env[:0:0]
+	for _, e := range cmd.Env {
+		if js, found := strings.CutPrefix(e, ToolIsolation_env+"="); found {
+			json.Unmarshal([]byte(js), &cfg)
+		} else {
+			env = append(env, e)
+		}
+	}
+	fn(&cfg)
+	js, _ := json.Marshal(cfg)
+	cmd.Env = append(env, ToolIsolation_env+"="+string(js))
+}
+
+// Call after cmd.Wait(). Tool's changes are copied from overlays. Mounts were in tool's namespace, so new root is empty.
+func (iso *ToolIsolation) Destroy() {
+	if iso.upper != "" {
+		for i, dir := range iso.write {
+			err := iso.commit(filepath.Join(iso.upper, strconv.Itoa(i), "upper"), dir)
+			if err != nil {
+				fmt.Printf("Warning: tool's changes in '%s' were not saved: %v\n", dir, err)
+			}
+		}
+
+		//overlay's work folder has no permissions
+		filepath.WalkDir(iso.upper, func(path string, d fs.DirEntry, err error) error {
+			if d != nil && d.IsDir() {
+				os.Chmod(path, 0700)
+			}
+			return nil
+		})
+		os.RemoveAll(iso.upper)
+	}
+	os.Remove(iso.new_root)
+}
+
+// Copies overlay's upper folder into dst. Whiteouts delete files, opaque folders replace whole folder.
+func (iso *ToolIsolation) commit(upper string, dst string) error {
+	return filepath.WalkDir(upper, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(upper, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		//tools and denied files are read-only
+		if reason := iso.isReadOnly(target); reason != "" {
+			fmt.Printf("Warning: tool's change of '%s' was not saved: %s\n", target, reason)
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.Mode()&fs.ModeCharDevice != 0 && info.Sys().(*syscall.Stat_t).Rdev == 0:
+			return os.RemoveAll(target) //whiteout
+
+		case info.IsDir():
+			opaque := make([]byte, 1)
+			n, _ := syscall.Getxattr(path, "user.overlay.opaque", opaque)
+			if st, err := os.Lstat(target); err == nil && (!st.IsDir() || (n == 1 && opaque[0] == 'y')) {
+				err = os.RemoveAll(target) //symlink is replaced, not followed
+				if err != nil {
+					return err
+				}
+			}
+			err = os.Mkdir(target, info.Mode().Perm())
+			if os.IsExist(err) {
+				err = nil
+			}
+			return err
+
+		case info.Mode().IsRegular():
+			return _toolIsolation_copyFile(path, target, info.Mode().Perm())
+		}
+
+		fmt.Printf("Warning: tool's change of '%s' was not saved: symlinks and devices are not allowed\n", target)
+		return nil
+	})
+}
+
+// Returns why tool can't change path, "" = it can.
+func (iso *ToolIsolation) isReadOnly(path string) string {
+	rel, err := filepath.Rel(iso.root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "" //writable folder outside of repository
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == "tools" || strings.HasPrefix(rel, "tools/") {
+		return "tools are changed only by host"
+	}
+	for _, pattern := range iso.deny {
+		if SandboxPolicy_match(pattern, rel) {
+			return fmt.Sprintf("denied by '%s'", pattern)
+		}
+	}
+	return ""
+}
+
+// Writes into temporary file and renames it, so symlink at dst is replaced, not followed.
+func _toolIsolation_copyFile(src string, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	f, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) //fails after rename
+
+	_, err = io.Copy(f, in)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), dst)
+}
+
+// Must be called at the beginning of main(). When process was started as isolation init, it never returns.
+func ToolIsolation_runInit() {
+	js, found := os.LookupEnv(ToolIsolation_env)
+	if !found {
+		return
+	}
+	os.Unsetenv(ToolIsolation_env)
+
+	//capabilities, no_new_privs and seccomp are per-thread, exec must be called from the same thread
+	runtime.LockOSThread()
+
+	var cfg ToolIsolationConfig
+	err := json.Unmarshal([]byte(js), &cfg)
+	if err == nil {
+		err = _toolIsolation_init(&cfg)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "tool isolation:", err)
+		os.Exit(121)
+	}
+	if cfg.Probe {
+		os.Exit(0)
+	}
+
+	err = syscall.Exec(cfg.Bin, cfg.Args, os.Environ()) //NewToolEnv() from host
+	fmt.Fprintln(os.Stderr, "tool isolation: exec:", err)
+	os.Exit(121)
+}
+
+func _toolIsolation_init(cfg *ToolIsolationConfig) error {
+	nr := cfg.New_root
+
+	//nothing goes back to host
+	err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return fmt.Errorf("make / private: %w", err)
+	}
+	err = syscall.Mount("tmpfs", nr, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755,size=16m")
+	if err != nil {
+		return fmt.Errorf("tmpfs: %w", err)
+	}
+
+	//system
+	for _, dir := range []string{"/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64", "/libx32", "/etc"} {
+		info, err := os.Lstat(dir)
+		if err != nil {
+			continue //doesn't exist
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(dir)
+			if err != nil {
+				return err
+			}
+			err = os.Symlink(target, filepath.Join(nr, dir)) //merged /usr
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err = _toolIsolation_bind(dir, filepath.Join(nr, dir), true)
+		if err != nil {
+			return err
+		}
+	}
+
+	//devices
+	err = os.Mkdir(filepath.Join(nr, "dev"), 0755)
+	if err != nil {
+		return err
+	}
+	for _, dev := range []string{"/dev/null", "/dev/zero", "/dev/full", "/dev/random", "/dev/urandom"} {
+		err = _toolIsolation_bind(dev, filepath.Join(nr, dev), false)
+		if err != nil {
+			return err
+		}
+	}
+
+	//proc can fail inside containers, which mask parts of host's /proc. Go runtime works without it
+	err = os.Mkdir(filepath.Join(nr, "proc"), 0555)
+	if err != nil {
+		return err
+	}
+	syscall.Mount("proc", filepath.Join(nr, "proc"), "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+
+	//tmp
+	err = os.Mkdir(filepath.Join(nr, "tmp"), 01777)
+	if err != nil {
+		return err
+	}
+	err = syscall.Mount("tmpfs", filepath.Join(nr, "tmp"), "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777,size=64m")
+	if err != nil {
+		return fmt.Errorf("tmpfs /tmp: %w", err)
+	}
+
+	//repository is read-only, writable folders are overlays over it. Host copies changes after tool exits
+	err = _toolIsolation_bind(cfg.Root, filepath.Join(nr, cfg.Root), true)
+	if err != nil {
+		return err
+	}
+	for i, dir := range cfg.Write {
+		dst := filepath.Join(nr, dir)
+		err = os.MkdirAll(dst, 0755)
+		if err != nil {
+			return err
+		}
+		upper := filepath.Join(cfg.Upper, strconv.Itoa(i))
+		opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s,userxattr", dir, filepath.Join(upper, "upper"), filepath.Join(upper, "work"))
+		err = syscall.Mount("overlay", dst, "overlay", syscall.MS_NOSUID|syscall.MS_NODEV, opts)
+		if err != nil {
+			return fmt.Errorf("overlay %s: %w", dir, err)
+		}
+	}
+	for _, path := range cfg.Deny {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if info.IsDir() {
+			err = syscall.Mount("tmpfs", filepath.Join(nr, path), "tmpfs", syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, "size=4k")
+		} else {
+			err = syscall.Mount(filepath.Join(nr, "dev/null"), filepath.Join(nr, path), "", syscall.MS_BIND, "")
+		}
+		if err != nil {
+			return fmt.Errorf("hide %s: %w", path, err)
+		}
+	}
+
+	//connection to host
+	if cfg.Socket_dir != "" {
+		err = _toolIsolation_bind(cfg.Socket_dir, filepath.Join(nr, cfg.Socket_dir), false)
+		if err != nil {
+			return err
+		}
+	}
+
+	//switch root
+	old := filepath.Join(nr, ".old")
+	err = os.Mkdir(old, 0700)
+	if err != nil {
+		return err
+	}
+	err = syscall.PivotRoot(nr, old)
+	if err != nil {
+		return fmt.Errorf("pivot_root: %w", err)
+	}
+	err = syscall.Chdir("/")
+	if err != nil {
+		return err
+	}
+	err = syscall.Unmount("/.old", syscall.MNT_DETACH)
+	if err != nil {
+		return fmt.Errorf("umount old root: %w", err)
+	}
+	os.Remove("/.old")
+
+	err = syscall.Chdir(cfg.Root)
+	if err != nil {
+		return err
+	}
+	syscall.Sethostname([]byte("sky_agent_tool"))
+
+	//new root is done, tool can't change it
+	err = _toolIsolation_dropCapabilities()
+	if err != nil {
+		return err
+	}
+	return _seccomp_install()
+}
+
+// Bind mount, folders are created. Read-only bind needs remount, which must keep flags(nosuid, nodev, ...) of original mount.
+func _toolIsolation_bind(src string, dst string, read_only bool) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		err = os.MkdirAll(dst, 0755)
+	} else {
+		err = os.MkdirAll(filepath.Dir(dst), 0755)
+		if err == nil {
+			var f *os.File
+			f, err = os.OpenFile(dst, os.O_CREATE|os.O_RDONLY, 0644)
+			if err == nil {
+				f.Close()
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	err = syscall.Mount(src, dst, "", syscall.MS_BIND|syscall.MS_REC, "")
+	if err != nil {
+		return fmt.Errorf("bind %s: %w", src, err)
+	}
+
+	if read_only {
+		var st syscall.Statfs_t
+		err = syscall.Statfs(dst, &st)
+		if err != nil {
+			return err
+		}
+		keep := uintptr(st.Flags) & (syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC | syscall.MS_NOATIME | syscall.MS_NODIRATIME | syscall.MS_RELATIME)
+		err = syscall.Mount("", dst, "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY|keep, "")
+		if err != nil {
+			return fmt.Errorf("read-only %s: %w", src, err)
+		}
+	}
+	return nil
+}
+
+// Init is root in user namespace. Empty bounding set and capabilities mean that exec can't give them back.
+func _toolIsolation_dropCapabilities() error {
+	for cp := 0; ; cp++ {
+		_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_CAPBSET_DROP, uintptr(cp), 0)
+		if errno == syscall.EINVAL {
+			break //last capability
+		}
+		if errno != 0 {
+			return fmt.Errorf("PR_CAPBSET_DROP: %w", errno)
+		}
+	}
+
+	hdr := struct {
+		version uint32
+		pid     int32
+	}{version: 0x20080522} //_LINUX_CAPABILITY_VERSION_3
+	var data [2]struct {
+		effective   uint32
+		permitted   uint32
+		inheritable uint32
+	}
+	_, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0)
+	if errno != 0 {
+		return fmt.Errorf("capset: %w", errno)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestToolIsolationCommit(t *testing.T) {
+	root := t.TempDir()
+	upper := t.TempDir()
+	write := func(path string, data string) {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte(data), 0644)
+	}
+
+	//repository
+	write(filepath.Join(root, "disk/keep.txt"), "keep")
+	write(filepath.Join(root, "disk/change.txt"), "old")
+	write(filepath.Join(root, "disk/deleted.txt"), "deleted")
+	write(filepath.Join(root, "disk/opaque/old.txt"), "old")
+	write(filepath.Join(root, "outside.txt"), "outside")
+	os.Symlink(filepath.Join(root, "outside_dir"), filepath.Join(root, "disk/link"))
+	os.Mkdir(filepath.Join(root, "outside_dir"), 0755)
+
+	//tool's changes
+	write(filepath.Join(upper, "change.txt"), "new")
+	write(filepath.Join(upper, "new/file.txt"), "new")
+	write(filepath.Join(upper, "passwords.vault"), "denied")
+	write(filepath.Join(upper, "link/file.txt"), "through symlink")
+	os.Symlink(filepath.Join(root, "outside.txt"), filepath.Join(upper, "evil_link"))
+	whiteout := syscall.Mknod(filepath.Join(upper, "deleted.txt"), syscall.S_IFCHR, 0) == nil
+	write(filepath.Join(upper, "opaque/new.txt"), "new")
+	opaque := syscall.Setxattr(filepath.Join(upper, "opaque"), "user.overlay.opaque", []byte("y"), 0) == nil
+
+	iso := &ToolIsolation{root: root, deny: []string{"**/passwords.vault"}}
+	err := iso.commit(upper, filepath.Join(root, "disk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(path string) string {
+		data, err := os.ReadFile(filepath.Join(root, path))
+		if err != nil {
+			return "<none>"
+		}
+		return string(data)
+	}
+	expect := map[string]string{
+		"disk/keep.txt":        "keep",
+		"disk/change.txt":      "new",
+		"disk/new/file.txt":    "new",
+		"disk/passwords.vault": "<none>",
+		"outside_dir/file.txt": "<none>",
+		"disk/link/file.txt":   "through symlink", //symlink was replaced with folder
+		"disk/opaque/new.txt":  "new",
+		"outside.txt":          "outside",
+	}
+	if whiteout {
+		expect["disk/deleted.txt"] = "<none>"
+	}
+	if opaque {
+		expect["disk/opaque/old.txt"] = "<none>"
+	}
+	for path, want := range expect {
+		if got := read(path); got != want {
+			t.Errorf("%s: expected '%s', got '%s'", path, want, got)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(root, "disk/evil_link")); err == nil {
+		t.Error("symlink was copied")
+	}
+	if info, err := os.Lstat(filepath.Join(root, "disk/link")); err != nil || !info.IsDir() {
+		t.Error("symlink in repository was followed")
+	}
+}
+
+func TestToolIsolationReadOnly(t *testing.T) {
+	iso := &ToolIsolation{root: "/repo", deny: []string{"tools/**/bin", "passwords.vault*"}}
+	tests := []struct {
+		path     string
+		readOnly bool
+	}{
+		{"/repo/disk/a.txt", false},
+		{"/repo/tools", true},
+		{"/repo/tools/web_search/tool.go", true},
+		{"/repo/tools_other/a", false},
+		{"/repo/passwords.vault", true},
+		{"/other/a.txt", false},
+	}
+	for _, tt := range tests {
+		if got := iso.isReadOnly(tt.path) != ""; got != tt.readOnly {
+			t.Errorf("isReadOnly(%s) = %v, want %v", tt.path, got, tt.readOnly)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+//go:build !linux
+
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"sync"
+)
+
+// Namespaces are Linux only, tools run without them.
+type ToolIsolation struct {
+}
+
+var g_toolIsolation_once sync.Once
+
+func ToolIsolation_available() bool {
+	g_toolIsolation_once.Do(func() {
+		fmt.Println("Warning: tool isolation is supported only on Linux, tools run without it")
+	})
+	return false
+}
+
+func NewToolIsolation(cmd *exec.Cmd, fs Protocol_fsPolicy, net Protocol_netPolicy, server_addr string) (*ToolIsolation, error) {
+	return nil, fmt.Errorf("tool isolation is supported only on Linux")
+}
+
+func (iso *ToolIsolation) Destroy() {
+}
+
+func ToolIsolation_runInit() {
+}
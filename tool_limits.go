@@ -0,0 +1,118 @@
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Limits for one tool run. 0 = no limit.
+type ToolLimits struct {
+	Wall_sec         float64 //kill tool binary after that
+	Cpu_sec          int     //RLIMIT_CPU
+	Memory_mb        int     //cgroup memory.max or RLIMIT_DATA
+	Max_processes    int     //cgroup pids.max(only when cgroups v2 are available)
+	Max_result_bytes int     //size of tool's answer
+	Max_agent_depth  int     //how deep can SDK_RunAgent() nest agents
+}
+
+// Tool metadata, <tool>/tool.json. It's optional.
+type ToolMeta struct {
+	Limits ToolLimits
+	Risk   string `json:",omitempty"` //Tool_risk_*, "" = high
+}
+
+func LoadToolMeta(tool string) (ToolMeta, error) {
+	var meta ToolMeta
+
+	js, err := os.ReadFile(filepath.Join(tool, "tool.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return meta, nil
+		}
+		return meta, err
+	}
+
+	err = json.Unmarshal(js, &meta)
+	if err != nil {
+		return meta, fmt.Errorf("%s: %w", filepath.Join(tool, "tool.json"), err)
+	}
+	return meta, nil
+}
+
+func SaveToolMeta(tool string, meta ToolMeta) error {
+	js, err := json.MarshalIndent(meta, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(tool, "tool.json"), js, 0644)
+}
+
+// Tool can only make global limits stricter, because tools folder is writable by tools.
+func (limits ToolLimits) Merge(tool ToolLimits) ToolLimits {
+	return ToolLimits{
+		Wall_sec:         _limitMin(limits.Wall_sec, tool.Wall_sec),
+		Cpu_sec:          _limitMin(limits.Cpu_sec, tool.Cpu_sec),
+		Memory_mb:        _limitMin(limits.Memory_mb, tool.Memory_mb),
+		Max_processes:    _limitMin(limits.Max_processes, tool.Max_processes),
+		Max_result_bytes: _limitMin(limits.Max_result_bytes, tool.Max_result_bytes),
+		Max_agent_depth:  _limitMin(limits.Max_agent_depth, tool.Max_agent_depth),
+	}
+}
+
+// Smaller non-zero value.
+func _limitMin[T int | float64](a, b T) T {
+	if a <= 0 {
+		return b
+	}
+	if b <= 0 || a < b {
+		return a
+	}
+	return b
+}
+
+func (limits ToolLimits) GetWallTime() time.Duration {
+	return time.Duration(limits.Wall_sec * float64(time.Second))
+}
+
+func (limits ToolLimits) String() string {
+	var items []string
+	if limits.Wall_sec > 0 {
+		items = append(items, fmt.Sprintf("wall time %gsec", limits.Wall_sec))
+	}
+	if limits.Cpu_sec > 0 {
+		items = append(items, fmt.Sprintf("CPU time %dsec", limits.Cpu_sec))
+	}
+	if limits.Memory_mb > 0 {
+		items = append(items, fmt.Sprintf("memory %dMB", limits.Memory_mb))
+	}
+	if limits.Max_processes > 0 {
+		items = append(items, fmt.Sprintf("processes %d", limits.Max_processes))
+	}
+	if limits.Max_result_bytes > 0 {
+		items = append(items, fmt.Sprintf("result %d bytes", limits.Max_result_bytes))
+	}
+	if len(items) == 0 {
+		return "none"
+	}
+	return strings.Join(items, ", ")
+}
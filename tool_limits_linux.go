@@ -0,0 +1,263 @@
+//go:build linux
+
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+/*
+Tool binary is not started directly, when it has CPU or memory(without cgroup) limit. Host starts itself(/proc/self/exe) with ToolLimits_env.
+This process sets rlimits and execs the tool binary(or isolation init), so limits are set before tool's first instruction.
+Tool runs in its own process group(and cgroup), which is killed whole on timeout or cancel.
+*/
+
+const ToolLimits_env = "SKY_AGENT_TOOL_LIMITS"
+
+type ToolLimitsConfig struct {
+	Rlimits []ToolLimitsRlimit
+	Bin     string
+	Args    []string
+}
+
+type ToolLimitsRlimit struct {
+	Resource int
+	Cur      uint64
+	Max      uint64
+}
+
+// Memory and process count are set with cgroup v2(tool starts inside it), when we can create child cgroup. Otherwise memory is set with rlimit.
+type ToolLimitsOS struct {
+	limits ToolLimits
+	cmd    *exec.Cmd
+
+	cgroup_dir string
+	cgroup_fd  *os.File
+}
+
+var g_toolLimitsOS_cgroupWarning sync.Once
+
+// Call after NewToolIsolation(), its init is started by limits wrapper.
+func NewToolLimitsOS(cmd *exec.Cmd, limits ToolLimits) *ToolLimitsOS {
+	los := &ToolLimitsOS{limits: limits, cmd: cmd}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true //tool's children are killed with it
+	if cmd.Cancel != nil {
+		cmd.Cancel = los.kill //exec.CommandContext()
+	}
+
+	if limits.Memory_mb > 0 || limits.Max_processes > 0 {
+		err := los.createCgroup()
+		if err == nil {
+			cmd.SysProcAttr.UseCgroupFD = true
+			cmd.SysProcAttr.CgroupFD = int(los.cgroup_fd.Fd())
+		} else {
+			g_toolLimitsOS_cgroupWarning.Do(func() {
+				fmt.Printf("Warning: cgroup v2 can't be used(%v). Tool's memory is limited only by RLIMIT_DATA and process count is not limited\n", err)
+			})
+		}
+	}
+
+	var rlimits []ToolLimitsRlimit
+	if limits.Cpu_sec > 0 {
+		//soft limit sends SIGXCPU, hard limit SIGKILL
+		rlimits = append(rlimits, ToolLimitsRlimit{Resource: syscall.RLIMIT_CPU, Cur: uint64(limits.Cpu_sec), Max: uint64(limits.Cpu_sec) + 1})
+	}
+	if limits.Memory_mb > 0 && los.cgroup_dir == "" {
+		//RLIMIT_AS doesn't work with Go, runtime reserves lot of address space
+		sz := uint64(limits.Memory_mb) * 1024 * 1024
+		rlimits = append(rlimits, ToolLimitsRlimit{Resource: syscall.RLIMIT_DATA, Cur: sz, Max: sz})
+	}
+	if len(rlimits) > 0 {
+		cfg := ToolLimitsConfig{Rlimits: rlimits, Bin: cmd.Path, Args: cmd.Args}
+		js, _ := json.Marshal(cfg)
+		cmd.Path = "/proc/self/exe"
+		cmd.Args = []string{"sky_agent_tool_limits"}
+		if cmd.Env == nil {
+			cmd.Env = NewToolEnv("")
+		}
+		cmd.Env = append(cmd.Env, ToolLimits_env+"="+string(js))
+	}
+
+	return los
+}
+
+// Must be called at the beginning of main(). When process was started as limits wrapper, it never returns.
+func ToolLimits_runInit() {
+	js, found := os.LookupEnv(ToolLimits_env)
+	if !found {
+		return
+	}
+	os.Unsetenv(ToolLimits_env)
+
+	var cfg ToolLimitsConfig
+	err := json.Unmarshal([]byte(js), &cfg)
+	for _, rl := range cfg.Rlimits {
+		if err == nil {
+			err = syscall.Setrlimit(rl.Resource, &syscall.Rlimit{Cur: rl.Cur, Max: rl.Max})
+		}
+	}
+	if err == nil {
+		err = syscall.Exec(cfg.Bin, cfg.Args, os.Environ()) //tool or isolation init
+	}
+	fmt.Fprintln(os.Stderr, "tool limits:", err)
+	os.Exit(121)
+}
+
+// Kills tool's process group and cgroup. Used by exec.CommandContext() on timeout or cancel.
+func (los *ToolLimitsOS) kill() error {
+	los.killCgroup()
+	if los.cmd.Process == nil {
+		return nil
+	}
+	err := syscall.Kill(-los.cmd.Process.Pid, syscall.SIGKILL)
+	if err == syscall.ESRCH {
+		return os.ErrProcessDone
+	}
+	return err
+}
+
+func (los *ToolLimitsOS) killCgroup() {
+	if los.cgroup_dir != "" {
+		os.WriteFile(filepath.Join(los.cgroup_dir, "cgroup.kill"), []byte("1"), 0) //Linux 5.14+
+	}
+}
+
+// Call after cmd.Wait(). Processes which tool left running are killed.
+func (los *ToolLimitsOS) Destroy() {
+	if los.cmd.Process != nil {
+		syscall.Kill(-los.cmd.Process.Pid, syscall.SIGKILL) //pid of group leader is not reused while group exists
+	}
+	los.killCgroup()
+	if los.cgroup_fd != nil {
+		los.cgroup_fd.Close()
+	}
+	if los.cgroup_dir != "" {
+		os.Remove(los.cgroup_dir) //works only when it's empty
+	}
+}
+
+// Returns which limit killed the tool or "".
+func (los *ToolLimitsOS) GetExitReason(exitErr error) string {
+	if los.cgroup_dir != "" {
+		events, _ := os.ReadFile(filepath.Join(los.cgroup_dir, "memory.events"))
+		for _, ln := range strings.Split(string(events), "\n") {
+			if n, found := strings.CutPrefix(ln, "oom_kill "); found && n != "0" {
+				return fmt.Sprintf("it reached memory limit(%dMB)", los.limits.Memory_mb)
+			}
+		}
+	}
+
+	var ee *exec.ExitError
+	if !errors.As(exitErr, &ee) {
+		return ""
+	}
+	ws, ok := ee.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() {
+		return ""
+	}
+	switch ws.Signal() {
+	case syscall.SIGXCPU:
+		return fmt.Sprintf("it reached CPU time limit(%dsec)", los.limits.Cpu_sec)
+	case syscall.SIGKILL:
+		if los.limits.Cpu_sec > 0 || los.limits.Memory_mb > 0 {
+			return fmt.Sprintf("it was killed, probably because of limits(%s)", los.limits.String())
+		}
+	}
+	return ""
+}
+
+func (los *ToolLimitsOS) createCgroup() error {
+	//cgroup v2 only
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err != nil {
+		return fmt.Errorf("cgroup v2 not mounted")
+	}
+
+	//our cgroup: "0::/path"
+	js, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return err
+	}
+	var self string
+	for _, ln := range strings.Split(string(js), "\n") {
+		if path, found := strings.CutPrefix(ln, "0::"); found {
+			self = filepath.Join("/sys/fs/cgroup", path)
+		}
+	}
+	if self == "" {
+		return fmt.Errorf("cgroup v2 path not found")
+	}
+
+	//controllers must be enabled for children
+	controls, err := os.ReadFile(filepath.Join(self, "cgroup.subtree_control"))
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for _, ctrl := range []string{"memory", "pids"} {
+		if !slices.Contains(strings.Fields(string(controls)), ctrl) {
+			missing = append(missing, ctrl)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("controllers '%s' are not in %s/cgroup.subtree_control, start sky_agent in delegated cgroup, for example 'systemd-run --user --scope -p Delegate=yes ./sky_agent'", strings.Join(missing, " "), self)
+	}
+
+	dir, err := os.MkdirTemp(self, "sky_agent_tool_")
+	if err != nil {
+		return fmt.Errorf("can't create cgroup: %w", err)
+	}
+
+	if los.limits.Memory_mb > 0 {
+		err = os.WriteFile(filepath.Join(dir, "memory.max"), []byte(strconv.Itoa(los.limits.Memory_mb*1024*1024)), 0)
+		if err == nil {
+			err = os.WriteFile(filepath.Join(dir, "memory.swap.max"), []byte("0"), 0)
+		}
+	}
+	if err == nil && los.limits.Max_processes > 0 {
+		err = os.WriteFile(filepath.Join(dir, "pids.max"), []byte(strconv.Itoa(los.limits.Max_processes)), 0)
+	}
+	if err != nil {
+		os.Remove(dir)
+		return err
+	}
+
+	fd, err := os.Open(dir)
+	if err != nil {
+		os.Remove(dir)
+		return err
+	}
+
+	los.cgroup_dir = dir
+	los.cgroup_fd = fd
+	return nil
+}
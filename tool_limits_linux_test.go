@@ -0,0 +1,84 @@
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Test binary is started as limits wrapper or isolation init too.
+func TestMain(m *testing.M) {
+	ToolLimits_runInit()
+	ToolIsolation_runInit()
+	os.Exit(m.Run())
+}
+
+func TestToolLimitsRlimit(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", "ulimit -t; ulimit -d")
+	los := NewToolLimitsOS(cmd, ToolLimits{Cpu_sec: 7, Memory_mb: 512})
+	defer los.Destroy()
+	if los.cgroup_dir != "" {
+		t.Skip("memory is limited by cgroup")
+	}
+
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Fields(string(out)); len(got) != 2 || got[0] != "7" || got[1] != "524288" {
+		t.Fatalf("expected rlimits 7 and 524288, got %q", out)
+	}
+}
+
+func TestToolLimitsKillGroup(t *testing.T) {
+	pid_file := filepath.Join(t.TempDir(), "pid")
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	//child in background keeps running after its parent is killed
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", "sleep 60 & echo $! > "+pid_file+"; wait")
+	los := NewToolLimitsOS(cmd, ToolLimits{})
+	err := cmd.Run()
+	los.Destroy()
+	if err == nil {
+		t.Fatal("command was not killed")
+	}
+
+	js, err := os.ReadFile(pid_file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pid int
+	_, err = fmt.Sscan(string(js), &pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err == nil && !strings.Contains(string(stat), ") Z ") { //zombie is dead, but init may not reap it
+		syscall.Kill(pid, syscall.SIGKILL)
+		t.Fatal("child of tool is still running")
+	}
+}
@@ -0,0 +1,50 @@
+//go:build !linux
+
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"sync"
+)
+
+// CPU, memory and process limits are implemented only on Linux. Wall time, result size and agent depth work everywhere.
+type ToolLimitsOS struct {
+}
+
+var _toolLimitsOS_warning sync.Once
+
+func NewToolLimitsOS(cmd *exec.Cmd, limits ToolLimits) *ToolLimitsOS {
+	if limits.Cpu_sec > 0 || limits.Memory_mb > 0 || limits.Max_processes > 0 {
+		_toolLimitsOS_warning.Do(func() {
+			fmt.Println("Warning: CPU, memory and process limits are supported only on Linux")
+		})
+	}
+	return &ToolLimitsOS{}
+}
+
+func (los *ToolLimitsOS) Destroy() {
+}
+
+func ToolLimits_runInit() {
+}
+
+func (los *ToolLimitsOS) GetExitReason(exitErr error) string {
+	return ""
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Keeps only last max_bytes of tool's stdout or stderr.
+type ToolOutput struct {
+	lock      sync.Mutex
+	max_bytes int
+	data      []byte
+	dropped   int //number of bytes which didn't fit
+}
+
+func NewToolOutput(max_bytes int) *ToolOutput {
+	return &ToolOutput{max_bytes: max_bytes}
+}
+
+func (out *ToolOutput) Write(p []byte) (int, error) {
+	out.lock.Lock()
+	defer out.lock.Unlock()
+
+	out.data = append(out.data, p...)
+	if len(out.data) > out.max_bytes {
+		cut := len(out.data) - out.max_bytes
+		out.dropped += cut
+		out.data = append(out.data[:0], out.data[cut:]...)
+	}
+	return len(p), nil
+}
+
+func (out *ToolOutput) String() string {
+	out.lock.Lock()
+	defer out.lock.Unlock()
+
+	if out.dropped > 0 {
+		return fmt.Sprintf("...(%d bytes cut)\n%s", out.dropped, out.data)
+	}
+	return string(out.data)
+}
+
+// Returns last max_bytes.
+func (out *ToolOutput) Tail(max_bytes int) string {
+	out.lock.Lock()
+	defer out.lock.Unlock()
+
+	if len(out.data) > max_bytes {
+		return "..." + string(out.data[len(out.data)-max_bytes:])
+	}
+	return string(out.data)
+}
@@ -0,0 +1,166 @@
+//go:build linux
+
+/*
+Copyright 2025 Milan Suk
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this db except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// Seccomp filter for tool binaries, built by hand(no libseccomp). Everything is allowed except syscalls, which could change the sandbox, reach other processes or the kernel.
+
+type _seccomp_arch struct {
+	audit  uint32   //AUDIT_ARCH_*
+	clone  uint32   //clone() number, its flags are checked
+	denied []uint32 //always EPERM
+}
+
+// Syscalls with the same number on all architectures.
+var g_seccomp_common = []uint32{
+	428, //open_tree
+	429, //move_mount
+	430, //fsopen
+	431, //fsconfig
+	432, //fsmount
+	433, //fspick
+	438, //pidfd_getfd
+	442, //mount_setattr
+}
+
+var g_seccomp_archs = map[string]_seccomp_arch{
+	"amd64": {
+		audit: 0xC000003E,
+		clone: 56,
+		denied: []uint32{
+			165, 166, 155, 161, //mount, umount2, pivot_root, chroot
+			101, 310, 311, //ptrace, process_vm_readv, process_vm_writev
+			246, 320, 175, 313, 176, //kexec_load, kexec_file_load, init_module, finit_module, delete_module
+			298, 321, 323, //perf_event_open, bpf, userfaultfd
+			250, 248, 249, //keyctl, add_key, request_key
+			272, 308, //unshare, setns
+			169, 167, 168, 103, 163, //reboot, swapon, swapoff, syslog, acct
+			303, 304, //name_to_handle_at, open_by_handle_at
+			172, 173, //iopl, ioperm
+		},
+	},
+	"arm64": {
+		audit: 0xC00000B7,
+		clone: 220,
+		denied: []uint32{
+			40, 39, 41, 51, //mount, umount2, pivot_root, chroot
+			117, 270, 271, //ptrace, process_vm_readv, process_vm_writev
+			104, 294, 105, 273, 106, //kexec_load, kexec_file_load, init_module, finit_module, delete_module
+			241, 280, 282, //perf_event_open, bpf, userfaultfd
+			219, 217, 218, //keyctl, add_key, request_key
+			97, 268, //unshare, setns
+			142, 224, 225, 116, 89, //reboot, swapon, swapoff, syslog, acct
+			264, 265, //name_to_handle_at, open_by_handle_at
+		},
+	},
+}
+
+const (
+	_seccomp_ret_kill_process = 0x80000000
+	_seccomp_ret_errno        = 0x00050000
+	_seccomp_ret_allow        = 0x7fff0000
+
+	_seccomp_sys_clone3 = 435
+
+	_seccomp_clone_ns = syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS | 0x02000000 //CLONE_NEWCGROUP
+)
+
+func _seccomp_getArch() *_seccomp_arch {
+	arch, found := g_seccomp_archs[runtime.GOARCH]
+	if !found {
+		return nil
+	}
+	return &arch
+}
+
+func _seccomp_build(arch *_seccomp_arch) []syscall.SockFilter {
+	stmt := func(code uint16, k uint32) syscall.SockFilter {
+		return syscall.SockFilter{Code: code, K: k}
+	}
+	jump := func(code uint16, k uint32, jt, jf uint8) syscall.SockFilter {
+		return syscall.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+	}
+	const (
+		ld   = syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS
+		jeq  = syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K
+		jge  = syscall.BPF_JMP | syscall.BPF_JGE | syscall.BPF_K
+		jset = syscall.BPF_JMP | syscall.BPF_JSET | syscall.BPF_K
+		ret  = syscall.BPF_RET | syscall.BPF_K
+	)
+
+	//struct seccomp_data: nr(0), arch(4), instruction_pointer(8), args(16)
+	prog := []syscall.SockFilter{
+		stmt(ld, 4),
+		jump(jeq, arch.audit, 1, 0),
+		stmt(ret, _seccomp_ret_kill_process), //other ABI(32-bit)
+		stmt(ld, 0),
+		jump(jge, 0x40000000, 0, 1), //x32 ABI
+		stmt(ret, _seccomp_ret_errno|uint32(syscall.EPERM)),
+	}
+
+	for _, nr := range append(arch.denied, g_seccomp_common...) {
+		prog = append(prog,
+			jump(jeq, nr, 0, 1),
+			stmt(ret, _seccomp_ret_errno|uint32(syscall.EPERM)))
+	}
+
+	//clone3 flags are in memory, filter can't read them. Go and libc fall back to clone()
+	prog = append(prog,
+		jump(jeq, _seccomp_sys_clone3, 0, 1),
+		stmt(ret, _seccomp_ret_errno|uint32(syscall.ENOSYS)))
+
+	//clone() can't create namespaces, flags are the first argument(lower 32 bits)
+	prog = append(prog,
+		jump(jeq, arch.clone, 0, 3),
+		stmt(ld, 16),
+		jump(jset, _seccomp_clone_ns, 0, 1),
+		stmt(ret, _seccomp_ret_errno|uint32(syscall.EPERM)),
+		stmt(ret, _seccomp_ret_allow))
+
+	return prog
+}
+
+// Sets no_new_privs and installs filter for calling thread, it's inherited by exec.
+func _seccomp_install() error {
+	arch := _seccomp_getArch()
+	if arch == nil {
+		return fmt.Errorf("seccomp filter is not implemented for %s", runtime.GOARCH)
+	}
+
+	const PR_SET_NO_NEW_PRIVS = 38
+	_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, PR_SET_NO_NEW_PRIVS, 1, 0)
+	if errno != 0 {
+		return fmt.Errorf("PR_SET_NO_NEW_PRIVS: %w", errno)
+	}
+
+	filter := _seccomp_build(arch)
+	prog := syscall.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	const SECCOMP_MODE_FILTER = 2
+	_, _, errno = syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_SECCOMP, SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return fmt.Errorf("PR_SET_SECCOMP: %w", errno)
+	}
+	return nil
+}
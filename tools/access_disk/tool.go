@@ -36,7 +36,10 @@ func (st *access_disk) run() string {
 
 	fmt.Println("UserPrompt:", UserPrompt)
 
-	answer := SDK_RunAgent("agent", 20, 20000, SystemPrompt, UserPrompt)
+	answer, err := SDK_RunAgent("agent", 20, 20000, SystemPrompt, UserPrompt)
+	if err != nil {
+		return err.Error() //sub-agent failed or budget was used
+	}
 
 	return answer
 }
@@ -18,7 +18,7 @@ func (st *create_new_tool) run() string {
 
 	UserPrompt += "These are the APIs:\n"
 	UserPrompt += "//When you login to any service this function converts password_id into password.\n"
-	UserPrompt += "func SDK_GetPassword(id string) string	//returns password.\n\n"
+	UserPrompt += "func SDK_GetPassword(id string) (string, error)	//returns password.\n\n"
 	UserPrompt += "\n"
 
 	UserPrompt += "This is the file(code) template:"
@@ -48,19 +48,21 @@ func (st *%s) run() <tool_return_type> {
 
 	fmt.Println("create_new_tool UserPrompt:", UserPrompt)
 
-	code_answer := SDK_RunAgent("coder", 20, 20000, SystemPrompt, UserPrompt)
+	code_answer, err := SDK_RunAgent("coder", 20, 20000, SystemPrompt, UserPrompt)
+	if err != nil {
+		return err.Error()
+	}
 
 	var ok bool
 	code_answer, ok = strings.CutPrefix(code_answer, "```go")
 	if ok {
 		code_answer, ok = strings.CutSuffix(code_answer, "```")
 		if ok {
-			compile_answer := SDK_SetToolCode(st.Name, code_answer)
-			if compile_answer == "" {
-				return "success"
-			} else {
-				return compile_answer //error
+			err := SDK_SetToolCode(st.Name, code_answer)
+			if err != nil {
+				return err.Error() //compiler error
 			}
+			return "success"
 		}
 	}
 
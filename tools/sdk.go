@@ -19,7 +19,9 @@ package main
 import (
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
@@ -30,21 +32,38 @@ var _sdk_client *SDK_NetClient
 
 func main() {
 	if len(os.Args) < 2 {
-		log.Fatal("missing 'port' argument: ", os.Args)
+		log.Fatal("missing 'port' or 'socket path' argument: ", os.Args)
 	}
-	port, err := strconv.Atoi(os.Args[1])
-	if err != nil {
-		log.Fatal(err)
+	token := os.Getenv("SKY_AGENT_TOOL_TOKEN")
+	if token == "" {
+		log.Fatal("missing SKY_AGENT_TOOL_TOKEN env variable")
 	}
+	os.Unsetenv("SKY_AGENT_TOOL_TOKEN")
 
 	//connect to server
-	_sdk_client = SDK_NewNetClient("localhost", port)
+	var err error
+	_sdk_client, err = SDK_NewNetClient(os.Args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
 	defer _sdk_client.Destroy()
 
+	//tell server who we are
+	err = _sdk_client.Hello(token)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	//get tool input
-	input := _sdk_client.ReadArray()
+	var input _sdk_input
+	err = _sdk_client.ReadFrame(_sdk_type_input, 0, &input)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_sandbox_fs = input.Fs_policy
+	_sandbox_initNet(input.Net_policy)
 	var st _replace_with_tool_structure_
-	err = json.Unmarshal(input, &st)
+	err = json.Unmarshal([]byte(input.Arguments), &st)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -64,112 +83,201 @@ func main() {
 	}*/
 
 	//send back result
-	_sdk_client.WriteInt(1)
-	_sdk_client.WriteArray(output)
-
+	err = _sdk_client.WriteFrame(_sdk_type_result, 0, _sdk_result{Result: output})
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
-// use_case = "agent", "coder", "search"
-func SDK_RunAgent(use_case string, max_iters int, max_tokens int, systemPrompt string, userPrompt string) string {
-	_sdk_client.WriteInt(2)
-	_sdk_client.WriteInt(uint64(max_iters))
-	_sdk_client.WriteInt(uint64(max_tokens))
-	_sdk_client.WriteArray([]byte(use_case))
-	_sdk_client.WriteArray([]byte(systemPrompt))
-	_sdk_client.WriteArray([]byte(userPrompt))
-
-	js := _sdk_client.ReadArray()
-	return string(js)
+// use_case = "agent", "coder", "search" or any use case from host's models.json. Returns final answer of the agent.
+// Sub-agent shares host's budget(-budget_* flags), error is returned when it's used.
+func SDK_RunAgent(use_case string, max_iters int, max_tokens int, systemPrompt string, userPrompt string) (string, error) {
+	var reply struct {
+		Answer string
+	}
+	err := _sdk_client.Call(_sdk_type_run_agent, _sdk_runAgent{Use_case: use_case, Max_iters: max_iters, Max_tokens: max_tokens, System_prompt: systemPrompt, User_prompt: userPrompt}, &reply)
+	return reply.Answer, err
 }
 
-func SDK_SetToolCode(toolName string, code string) string {
-	_sdk_client.WriteInt(3)
-	_sdk_client.WriteArray([]byte(toolName))
-	_sdk_client.WriteArray([]byte(code))
+// Writes and compiles the tool. Compiler error is returned as error.
+func SDK_SetToolCode(toolName string, code string) error {
+	return _sdk_client.Call(_sdk_type_set_tool_code, _sdk_setToolCode{Tool_name: toolName, Code: code}, &struct{}{})
+}
 
-	js := _sdk_client.ReadArray()
-	return string(js)
+// Returns true if operation should be blocked.
+func SDK_Sandbox_violation(err error) (bool, error) {
+	var reply struct {
+		Block bool
+	}
+	err = _sdk_client.Call(_sdk_type_sandbox_violation, _sdk_sandboxViolation{Info: err.Error()}, &reply)
+	if err != nil {
+		return true, err //block when host doesn't answer
+	}
+	return reply.Block, nil
 }
-func SDK_Sandbox_violation(err error) bool {
-	_sdk_client.WriteInt(4)
-	_sdk_client.WriteArray([]byte(err.Error()))
 
-	blockIt := _sdk_client.ReadInt()
-	return blockIt != 0
+// Converts password_id into password.
+func SDK_GetPassword(id string) (string, error) {
+	var reply struct {
+		Password string
+	}
+	err := _sdk_client.Call(_sdk_type_get_password, _sdk_getPassword{Id: id}, &reply)
+	return reply.Password, err
 }
-func SDK_GetPassword(id string) string {
-	_sdk_client.WriteInt(5)
-	_sdk_client.WriteArray([]byte(id))
 
-	password := _sdk_client.ReadArray()
-	return string(password)
+// Protocol is described in host's protocol.go. Frame: [type][request_id][payload_size][JSON payload]
+const _sdk_protocol_version = 3
+
+const (
+	_sdk_type_result            = 1
+	_sdk_type_run_agent         = 2
+	_sdk_type_set_tool_code     = 3
+	_sdk_type_sandbox_violation = 4
+	_sdk_type_get_password      = 5
+	_sdk_type_hello             = 6
+	_sdk_type_input             = 7
+	_sdk_type_reply             = 8
+	_sdk_type_error             = 9
+)
+
+type _sdk_hello struct {
+	Version int
+	Token   string `json:",omitempty"`
+}
+type _sdk_input struct {
+	Arguments  string
+	Fs_policy  _sdk_fsPolicy
+	Net_policy _sdk_netPolicy
+}
+type _sdk_fsPolicy struct {
+	Root  string
+	Read  []string
+	Write []string
+	Deny  []string
+}
+type _sdk_netPolicy struct {
+	Mode  string
+	Allow []string
+}
+type _sdk_result struct {
+	Result json.RawMessage
+}
+type _sdk_error struct {
+	Message string
+}
+type _sdk_runAgent struct {
+	Use_case      string
+	Max_iters     int
+	Max_tokens    int
+	System_prompt string
+	User_prompt   string
+}
+type _sdk_setToolCode struct {
+	Tool_name string
+	Code      string
+}
+type _sdk_sandboxViolation struct {
+	Info string
+}
+type _sdk_getPassword struct {
+	Id string
 }
 
 type SDK_NetClient struct {
-	conn *net.TCPConn
+	conn            net.Conn
+	last_request_id uint64
 }
 
-func SDK_NewNetClient(addr string, port int) *SDK_NetClient {
-	tcpAddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", addr, port))
-	if err != nil {
-		log.Fatal(err)
+// addr is port number(TCP on localhost) or path to Unix socket.
+func SDK_NewNetClient(addr string) (*SDK_NetClient, error) {
+	network := "unix"
+	port, err := strconv.Atoi(addr)
+	if err == nil {
+		network = "tcp"
+		addr = fmt.Sprintf("localhost:%d", port)
 	}
 
-	conn, err := net.DialTCP("tcp", nil, tcpAddr)
+	conn, err := net.Dial(network, addr)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	return &SDK_NetClient{conn: conn}
+	return &SDK_NetClient{conn: conn}, nil
 }
 func (client *SDK_NetClient) Destroy() {
 	client.conn.Close()
 }
 
-func (client *SDK_NetClient) ReadInt() uint64 {
-	var sz [8]byte
-	_, err := client.conn.Read(sz[:])
+func (client *SDK_NetClient) Hello(token string) error {
+	err := client.WriteFrame(_sdk_type_hello, 0, _sdk_hello{Version: _sdk_protocol_version, Token: token})
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	return binary.LittleEndian.Uint64(sz[:])
+	var hello _sdk_hello
+	err = client.ReadFrame(_sdk_type_hello, 0, &hello)
+	if err != nil {
+		return err
+	}
+	if hello.Version != _sdk_protocol_version {
+		return fmt.Errorf("host uses protocol version %d, tool %d", hello.Version, _sdk_protocol_version)
+	}
+	return nil
 }
 
-func (client *SDK_NetClient) WriteInt(value uint64) {
-	var val [8]byte
-	binary.LittleEndian.PutUint64(val[:], value)
-	_, err := client.conn.Write(val[:])
+// Sends request and waits for reply. Host's error frame is returned as error.
+func (client *SDK_NetClient) Call(tp uint64, payload interface{}, reply interface{}) error {
+	client.last_request_id++
+	err := client.WriteFrame(tp, client.last_request_id, payload)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	return client.ReadFrame(_sdk_type_reply, client.last_request_id, reply)
 }
 
-func (client *SDK_NetClient) ReadArray() []byte {
-	//recv size
-	size := client.ReadInt()
+func (client *SDK_NetClient) ReadFrame(tp uint64, request_id uint64, payload interface{}) error {
+	var header [24]byte
+	_, err := io.ReadFull(client.conn, header[:])
+	if err != nil {
+		return err
+	}
+	frame_tp := binary.LittleEndian.Uint64(header[0:])
+	frame_request_id := binary.LittleEndian.Uint64(header[8:])
+	size := binary.LittleEndian.Uint64(header[16:])
 
-	//recv data
 	data := make([]byte, size)
-	p := 0
-	for p < int(size) {
-		n, err := client.conn.Read(data[p:])
-		if err != nil {
-			log.Fatal(err)
-		}
-		p += n
+	_, err = io.ReadFull(client.conn, data)
+	if err != nil {
+		return err
 	}
 
-	return data
-}
+	if frame_request_id != request_id {
+		return fmt.Errorf("expected reply for request %d, received %d", request_id, frame_request_id)
+	}
+	if frame_tp == _sdk_type_error {
+		var e _sdk_error
+		json.Unmarshal(data, &e)
+		return errors.New(e.Message)
+	}
+	if frame_tp != tp {
+		return fmt.Errorf("expected frame type %d, received %d", tp, frame_tp)
+	}
 
-func (client *SDK_NetClient) WriteArray(data []byte) {
-	//send size
-	client.WriteInt(uint64(len(data)))
+	return json.Unmarshal(data, payload)
+}
 
-	//send data
-	_, err := client.conn.Write(data)
+func (client *SDK_NetClient) WriteFrame(tp uint64, request_id uint64, payload interface{}) error {
+	js, err := json.Marshal(payload)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+
+	data := make([]byte, 24, 24+len(js))
+	binary.LittleEndian.PutUint64(data[0:], tp)
+	binary.LittleEndian.PutUint64(data[8:], request_id)
+	binary.LittleEndian.PutUint64(data[16:], uint64(len(js)))
+	data = append(data, js...)
+
+	_, err = client.conn.Write(data)
+	return err
 }
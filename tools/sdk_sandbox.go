@@ -2,153 +2,553 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"debug/elf"
 	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
 	"io/fs"
-	"log"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 )
 
-func _sandbox_isPathValid(name string) bool {
-	curr, err := os.Getwd()
+var _sandbox_fs _sdk_fsPolicy //from host, see sandbox_policy.json
+
+// Returns absolute path with resolved symlinks. Path doesn't need to exist, then its deepest existing parent is resolved.
+func _sandbox_resolve(name string) (string, error) {
+	path, err := filepath.Abs(name)
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
-	curr1 := filepath.Join(curr, "disk")
-	curr2 := filepath.Join(curr, "tools")
 
-	path, err := filepath.Abs(name)
+	rest := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("path '%s' is a dangling symlink", path) //writing into it would create the target
+		}
+
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(path), rest)
+		path = parent
+	}
+}
+
+func _sandbox_isInside(path string, root string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+func _sandbox_isDenied(path string) bool {
+	rel, err := filepath.Rel(_sandbox_fs.Root, path)
+	if err != nil || !_sandbox_isInside(path, _sandbox_fs.Root) {
+		return false
+	}
+
+	//pattern can match the file or any of its parent folders
+	for rel = filepath.ToSlash(rel); rel != "." && rel != "/"; rel = filepath.ToSlash(filepath.Dir(rel)) {
+		for _, pattern := range _sandbox_fs.Deny {
+			if _sandbox_match(pattern, rel) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// filepath.Match(), but "**/" matches any number of folders. Same as SandboxPolicy_match() on host.
+func _sandbox_match(pattern string, rel string) bool {
+	before, after, found := strings.Cut(pattern, "**/")
+	if !found {
+		ok, _ := filepath.Match(pattern, rel)
+		return ok
+	}
+
+	parts := strings.Split(rel, "/")
+	for i := range parts {
+		if before != "" {
+			ok, _ := filepath.Match(strings.TrimSuffix(before, "/"), strings.Join(parts[:i], "/"))
+			if !ok {
+				continue
+			}
+		}
+		for j := i; j < len(parts); j++ {
+			if _sandbox_match(after, strings.Join(parts[j:], "/")) {
+				return true
+			}
+		}
+		if before == "" {
+			break //all depths were checked
+		}
+	}
+	return false
+}
+
+// Reports violation to host, which can ask operator. Returns true if operation was approved.
+func _sandbox_allowed(err error) bool {
+	block, _ := SDK_Sandbox_violation(err)
+	return !block
+}
+
+func _sandbox_check(name string, write bool, report bool) bool {
+	path, err := _sandbox_resolve(name)
 	if err != nil {
-		log.Fatal(err)
+		return report && _sandbox_allowed(fmt.Errorf("path '%s' can't be checked: %v", name, err))
+	}
+
+	if _sandbox_isDenied(path) {
+		return report && _sandbox_allowed(fmt.Errorf("path '%s' is denied by sandbox policy", path))
 	}
 
-	valid1 := strings.HasPrefix(path, curr1)
-	valid2 := strings.HasPrefix(path, curr2)
-	ok := (valid1 || valid2)
-	if !ok {
-		SDK_Sandbox_violation(fmt.Errorf("path '%s' is outside of program '%s' folder", path, curr))
+	for _, root := range _sandbox_fs.Write {
+		if _sandbox_isInside(path, root) {
+			return true
+		}
+	}
+	if !write {
+		for _, root := range _sandbox_fs.Read {
+			if _sandbox_isInside(path, root) {
+				return true
+			}
+		}
 	}
-	return ok
+
+	if !report {
+		return false
+	}
+	if write {
+		return _sandbox_allowed(fmt.Errorf("path '%s' is outside of writable folders %v", path, _sandbox_fs.Write))
+	}
+	roots := append([]string{}, _sandbox_fs.Read...)
+	for _, root := range _sandbox_fs.Write {
+		if !slices.Contains(roots, root) {
+			roots = append(roots, root)
+		}
+	}
+	return _sandbox_allowed(fmt.Errorf("path '%s' is outside of readable folders %v", path, roots))
+}
+
+func _sandbox_canWrite(name string) bool {
+	return _sandbox_check(name, true, true)
+}
+
+func _sandbox_canRead(name string) bool {
+	return _sandbox_check(name, false, true)
 }
 
+// Blocked command returns error from Start(), Run(), Output(), etc.
 func _exec_Command(name string, arg ...string) *exec.Cmd {
-	SDK_Sandbox_violation(fmt.Errorf("command '%s' blocked", name))
-	//exec.Command()
-	return nil
+	if !_sandbox_allowed(fmt.Errorf("command '%s %s' blocked", name, strings.Join(arg, " "))) {
+		return &exec.Cmd{Path: name, Args: append([]string{name}, arg...), Err: fmt.Errorf("command '%s' was blocked", name)}
+	}
+	return exec.Command(name, arg...)
 }
 
 func _exec_CommandContext(ctx context.Context, name string, arg ...string) *exec.Cmd {
-	//exec.CommandContext()
-	return nil
+	if !_sandbox_allowed(fmt.Errorf("command '%s %s' blocked", name, strings.Join(arg, " "))) {
+		return &exec.Cmd{Path: name, Args: append([]string{name}, arg...), Err: fmt.Errorf("command '%s' was blocked", name)}
+	}
+	return exec.CommandContext(ctx, name, arg...)
 }
 
 func _exec_StartProcess(name string, argv []string, attr *os.ProcAttr) (*os.Process, error) {
-	//os.StartProcess()
-	return nil, fmt.Errorf("StartProcess(%s, %v, %v) was blocked", name, argv, attr)
+	if !_sandbox_allowed(fmt.Errorf("process '%s %v' blocked", name, argv)) {
+		return nil, fmt.Errorf("StartProcess(%s, %v) was blocked", name, argv)
+	}
+	return os.StartProcess(name, argv, attr)
 }
 
 func _os_WriteFile(name string, data []byte, perm os.FileMode) error {
-	if !_sandbox_isPathValid(name) {
+	if !_sandbox_canWrite(name) {
 		return fmt.Errorf("WriteFile(%s) outside program folder", name)
 	}
 	return os.WriteFile(name, data, perm)
 }
 
 func _os_Mkdir(path string, perm os.FileMode) error {
-	if !_sandbox_isPathValid(path) {
+	if !_sandbox_canWrite(path) {
 		return fmt.Errorf("Mkdir(%s) outside program folder", path)
 	}
 	return os.Mkdir(path, perm)
 }
 func _os_MkdirAll(path string, perm os.FileMode) error {
-	if !_sandbox_isPathValid(path) {
+	if !_sandbox_canWrite(path) {
 		return fmt.Errorf("MkdirAll(%s) outside program folder", path)
 	}
 	return os.MkdirAll(path, perm)
 }
 
 func _os_Remove(path string) error {
-	if !_sandbox_isPathValid(path) {
+	if !_sandbox_canWrite(path) {
 		return fmt.Errorf("Remove(%s) outside program folder", path)
 	}
 	return os.Remove(path)
 }
 
 func _os_RemoveAll(path string) error {
-	if !_sandbox_isPathValid(path) {
+	if !_sandbox_canWrite(path) {
 		return fmt.Errorf("RemoveAll(%s) outside program folder", path)
 	}
 	return os.RemoveAll(path)
 }
 
 func _os_Rename(oldpath, newpath string) error {
-	if !_sandbox_isPathValid(oldpath) || !_sandbox_isPathValid(newpath) {
+	if !_sandbox_canWrite(oldpath) || !_sandbox_canWrite(newpath) {
 		return fmt.Errorf("Rename(%s, %s) outside program folder", oldpath, newpath)
 	}
 	return os.Rename(oldpath, newpath)
 }
 
 func _os_Chmod(path string, mode fs.FileMode) error {
-	if !_sandbox_isPathValid(path) {
-		return fmt.Errorf(" Chmod(%s) outside program folder", path)
+	if !_sandbox_canWrite(path) {
+		return fmt.Errorf("Chmod(%s) outside program folder", path)
 	}
 	return os.Chmod(path, mode)
 }
+
+func _os_Chown(path string, uid, gid int) error {
+	if !_sandbox_canWrite(path) {
+		return fmt.Errorf("Chown(%s) outside program folder", path)
+	}
+	return os.Chown(path, uid, gid)
+}
+
+func _os_Chtimes(path string, atime time.Time, mtime time.Time) error {
+	if !_sandbox_canWrite(path) {
+		return fmt.Errorf("Chtimes(%s) outside program folder", path)
+	}
+	return os.Chtimes(path, atime, mtime)
+}
+
 func _os_Chdir(path string) error {
-	if !_sandbox_isPathValid(path) {
+	if !_sandbox_canRead(path) {
 		return fmt.Errorf("Chdir(%s) outside program folder", path)
 	}
 	return os.Chdir(path)
 }
 
 func _os_Create(path string) (*os.File, error) {
-	if !_sandbox_isPathValid(path) {
+	if !_sandbox_canWrite(path) {
 		return nil, fmt.Errorf("Create(%s) outside program folder", path)
 	}
 	return os.Create(path)
 }
 
+func _os_CreateTemp(dir, pattern string) (*os.File, error) {
+	if !_sandbox_canWrite(dir) {
+		return nil, fmt.Errorf("CreateTemp(%s) outside program folder", dir)
+	}
+	return os.CreateTemp(dir, pattern)
+}
+
+func _os_MkdirTemp(dir, pattern string) (string, error) {
+	if !_sandbox_canWrite(dir) {
+		return "", fmt.Errorf("MkdirTemp(%s) outside program folder", dir)
+	}
+	return os.MkdirTemp(dir, pattern)
+}
+
+func _os_CopyFS(dir string, fsys fs.FS) error {
+	if !_sandbox_canWrite(dir) {
+		return fmt.Errorf("CopyFS(%s) outside program folder", dir)
+	}
+	return os.CopyFS(dir, fsys)
+}
+
 func _os_OpenFile(path string, flag int, perm fs.FileMode) (*os.File, error) {
-	if !_sandbox_isPathValid(path) && flag != os.O_RDONLY {
+	write := flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0
+	if !_sandbox_check(path, write, true) {
 		return nil, fmt.Errorf("OpenFile(%s) outside program folder", path)
 	}
 	return os.OpenFile(path, flag, perm)
 }
 
 func _os_Lchown(path string, uid, gid int) error {
-	if !_sandbox_isPathValid(path) {
+	if !_sandbox_canWrite(path) {
 		return fmt.Errorf("Lchown(%s) outside program folder", path)
 	}
 	return os.Lchown(path, uid, gid)
 }
 
 func _os_Truncate(path string, size int64) error {
-	if !_sandbox_isPathValid(path) {
+	if !_sandbox_canWrite(path) {
 		return fmt.Errorf("Truncate(%s) outside program folder", path)
 	}
 	return os.Truncate(path, size)
 }
 
 func _os_Link(oldpath, newpath string) error {
-	if !_sandbox_isPathValid(oldpath) || !_sandbox_isPathValid(newpath) {
+	if !_sandbox_canWrite(oldpath) || !_sandbox_canWrite(newpath) {
 		return fmt.Errorf("Link(%s, %s) outside program folder", oldpath, newpath)
 	}
 	return os.Link(oldpath, newpath)
 }
 
 func _os_Symlink(oldpath, newpath string) error {
-	if !_sandbox_isPathValid(oldpath) || !_sandbox_isPathValid(newpath) {
+	target := oldpath
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(newpath), target) //relative to link's folder
+	}
+	if !_sandbox_canWrite(target) || !_sandbox_canWrite(newpath) {
 		return fmt.Errorf("Symlink(%s, %s) outside program folder", oldpath, newpath)
 	}
 	return os.Symlink(oldpath, newpath)
 }
 
-func _os_NewFile(fd uintptr, path string) *os.File {
-	if !_sandbox_isPathValid(path) {
-		//fmt.Errorf("NewFile(%s) outside program folder", path)
-		return nil
+func _os_ReadFile(name string) ([]byte, error) {
+	if !_sandbox_canRead(name) {
+		return nil, fmt.Errorf("ReadFile(%s) outside program folder", name)
+	}
+	return os.ReadFile(name)
+}
+
+func _os_Open(name string) (*os.File, error) {
+	if !_sandbox_canRead(name) {
+		return nil, fmt.Errorf("Open(%s) outside program folder", name)
+	}
+	return os.Open(name)
+}
+
+func _os_ReadDir(name string) ([]os.DirEntry, error) {
+	if !_sandbox_canRead(name) {
+		return nil, fmt.Errorf("ReadDir(%s) outside program folder", name)
+	}
+	return os.ReadDir(name)
+}
+
+func _os_Stat(name string) (fs.FileInfo, error) {
+	if !_sandbox_canRead(name) {
+		return nil, fmt.Errorf("Stat(%s) outside program folder", name)
+	}
+	return os.Stat(name)
+}
+
+func _os_Lstat(name string) (fs.FileInfo, error) {
+	if !_sandbox_canRead(name) {
+		return nil, fmt.Errorf("Lstat(%s) outside program folder", name)
+	}
+	return os.Lstat(name)
+}
+
+func _os_Readlink(name string) (string, error) {
+	if !_sandbox_canRead(name) {
+		return "", fmt.Errorf("Readlink(%s) outside program folder", name)
+	}
+	return os.Readlink(name)
+}
+
+func _ioutil_ReadDir(dirname string) ([]fs.FileInfo, error) {
+	if !_sandbox_canRead(dirname) {
+		return nil, fmt.Errorf("ReadDir(%s) outside program folder", dirname)
+	}
+	return ioutil.ReadDir(dirname)
+}
+
+// Walk doesn't follow symlinks, files are checked again when they are opened.
+func _filepath_Walk(root string, fn filepath.WalkFunc) error {
+	if !_sandbox_canRead(root) {
+		return fmt.Errorf("Walk(%s) outside program folder", root)
+	}
+	return filepath.Walk(root, fn)
+}
+
+func _filepath_WalkDir(root string, fn fs.WalkDirFunc) error {
+	if !_sandbox_canRead(root) {
+		return fmt.Errorf("WalkDir(%s) outside program folder", root)
+	}
+	return filepath.WalkDir(root, fn)
+}
+
+// Unreadable matches are skipped.
+func _filepath_Glob(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, path := range matches {
+		if _sandbox_check(path, false, false) {
+			out = append(out, path)
+		}
+	}
+	return out, nil
+}
+
+func _http_ServeFile(w http.ResponseWriter, r *http.Request, name string) {
+	if !_sandbox_canRead(name) {
+		http.Error(w, fmt.Sprintf("ServeFile(%s) outside program folder", name), http.StatusForbidden)
+		return
+	}
+	http.ServeFile(w, r, name)
+}
+
+func _tls_LoadX509KeyPair(certFile, keyFile string) (tls.Certificate, error) {
+	if !_sandbox_canRead(certFile) || !_sandbox_canRead(keyFile) {
+		return tls.Certificate{}, fmt.Errorf("LoadX509KeyPair(%s, %s) outside program folder", certFile, keyFile)
+	}
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
+
+// File is read only if src is nil.
+func _parser_ParseFile(fset *token.FileSet, filename string, src any, mode parser.Mode) (*ast.File, error) {
+	if src == nil && !_sandbox_canRead(filename) {
+		return nil, fmt.Errorf("ParseFile(%s) outside program folder", filename)
+	}
+	return parser.ParseFile(fset, filename, src, mode)
+}
+
+func _parser_ParseDir(fset *token.FileSet, path string, filter func(fs.FileInfo) bool, mode parser.Mode) (map[string]*ast.Package, error) {
+	if !_sandbox_canRead(path) {
+		return nil, fmt.Errorf("ParseDir(%s) outside program folder", path)
+	}
+	return parser.ParseDir(fset, path, filter, mode)
+}
+
+func _elf_Open(name string) (*elf.File, error) {
+	if !_sandbox_canRead(name) {
+		return nil, fmt.Errorf("Open(%s) outside program folder", name)
+	}
+	return elf.Open(name)
+}
+
+var _sandbox_net _sdk_netPolicy //from host, see sandbox_policy.json
+
+// All HTTP requests go through policy checking dialer. Tool can't create its own Transport, Dialer or call net.Dial directly(sdk_sandbox_fns.txt).
+func _sandbox_initNet(policy _sdk_netPolicy) {
+	_sandbox_net = policy
+
+	tr := http.DefaultTransport.(*http.Transport)
+	tr.DialContext = _sandbox_dialContext
+	tr.DialTLSContext = nil
+	tr.Proxy = nil //proxy would hide the real host from the check
+}
+
+// Returns address which should be dialed. For 'loopback' it's the checked IP, so DNS can't change it later.
+func _sandbox_checkDial(ctx context.Context, network, address string) (string, error) {
+	if _sandbox_net.Mode == "all" {
+		return address, nil
+	}
+
+	switch network {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+	default:
+		return "", fmt.Errorf("connection '%s' to '%s' blocked by network policy '%s'", network, address, _sandbox_net.Mode)
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+
+	switch _sandbox_net.Mode {
+	case "loopback":
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return "", err
+		}
+		for _, ip := range ips {
+			if !ip.IP.IsLoopback() {
+				return "", fmt.Errorf("connection to '%s'(%s) blocked by network policy 'loopback'", address, ip.IP)
+			}
+		}
+		if len(ips) == 0 {
+			return "", fmt.Errorf("host '%s' not found", host)
+		}
+		return net.JoinHostPort(ips[0].IP.String(), port), nil
+
+	case "allowlist":
+		for _, allow := range _sandbox_net.Allow {
+			if _sandbox_matchHost(allow, host, port) {
+				return address, nil
+			}
+		}
+		return "", fmt.Errorf("connection to '%s' blocked by network policy, host is not in allowlist %v", address, _sandbox_net.Allow)
+	}
+
+	return "", fmt.Errorf("connection to '%s' blocked by network policy '%s'", address, _sandbox_net.Mode)
+}
+
+// allow is "host", "host:port", "*.domain" or "*.domain:port".
+func _sandbox_matchHost(allow string, host string, port string) bool {
+	allowHost := allow
+	if h, p, err := net.SplitHostPort(allow); err == nil {
+		if _, err := strconv.Atoi(p); err == nil {
+			if p != port {
+				return false
+			}
+			allowHost = h
+		}
+	}
+
+	allowHost = strings.ToLower(strings.Trim(allowHost, "[]"))
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if strings.HasPrefix(allowHost, "*.") {
+		return strings.HasSuffix(host, allowHost[1:])
+	}
+	return host == allowHost
+}
+
+func _sandbox_dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	addr, err := _sandbox_checkDial(ctx, network, address)
+	if err != nil {
+		if !_sandbox_allowed(err) {
+			return nil, err
+		}
+		addr = address
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
+
+func _net_Dial(network, address string) (net.Conn, error) {
+	return _sandbox_dialContext(context.Background(), network, address)
+}
+
+func _net_DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return _sandbox_dialContext(ctx, network, address)
+}
+
+func _tls_Dial(network, addr string, config *tls.Config) (*tls.Conn, error) {
+	conn, err := _sandbox_dialContext(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tconn := tls.Client(conn, config)
+	err = tconn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
 	}
-	return os.NewFile(fd, path)
+	return tconn, nil
 }
@@ -3,7 +3,6 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"strings"
 )
 
@@ -30,7 +29,10 @@ func (st *ui_user_form) run() interface{} {
 
 	fmt.Println("UserPrompt:", UserPrompt)
 
-	js := SDK_RunAgent("agent", 20, 20000, SystemPrompt, UserPrompt)
+	js, err := SDK_RunAgent("agent", 20, 20000, SystemPrompt, UserPrompt)
+	if err != nil {
+		return err.Error() //sub-agent failed or budget was used
+	}
 
 	fmt.Println("Js:", string(js))
 
@@ -43,9 +45,9 @@ func (st *ui_user_form) run() interface{} {
 
 	//parse
 	var items []Item
-	err := json.Unmarshal([]byte(js), &items)
+	err = json.Unmarshal([]byte(js), &items)
 	if err != nil {
-		log.Fatal(err)
+		return err.Error()
 	}
 
 	//render ....
@@ -35,19 +35,21 @@ func (st *update_tool) run() string {
 
 	fmt.Println("update_tool UserPrompt:", UserPrompt)
 
-	code_answer := SDK_RunAgent("coder", 20, 20000, SystemPrompt, UserPrompt)
+	code_answer, err := SDK_RunAgent("coder", 20, 20000, SystemPrompt, UserPrompt)
+	if err != nil {
+		return err.Error()
+	}
 
 	var ok bool
 	code_answer, ok = strings.CutPrefix(code_answer, "```go")
 	if ok {
 		code_answer, ok = strings.CutSuffix(code_answer, "```")
 		if ok {
-			compile_answer := SDK_SetToolCode(st.Name, code_answer)
-			if compile_answer == "" {
-				return "success"
-			} else {
-				//pass error back
+			err := SDK_SetToolCode(st.Name, code_answer)
+			if err != nil {
+				return err.Error() //compiler error
 			}
+			return "success"
 		}
 	}
 
@@ -9,7 +9,10 @@ func (st *web_search) run() string {
 
 	SystemPrompt := "Be precise and concise."
 
-	answer := SDK_RunAgent("search", 20, 20000, SystemPrompt, st.Prompt)
+	answer, err := SDK_RunAgent("search", 20, 20000, SystemPrompt, st.Prompt)
+	if err != nil {
+		return err.Error() //sub-agent failed or budget was used
+	}
 
 	return answer
 }
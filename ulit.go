@@ -23,7 +23,6 @@ import (
 	"go/ast"
 	"go/parser"
 	"go/token"
-	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -63,33 +62,25 @@ func NeedCompileTool(tool string) bool {
 func GetToolTimeStamp(tool string) []byte {
 	infoSdk, _ := os.Stat("tools/sdk.go")
 	infoSandbox, _ := os.Stat("tools/sdk_sandbox.go")
+	infoSandboxFns, _ := os.Stat("tools/sdk_sandbox_fns.txt")
 	infoTool, _ := os.Stat(filepath.Join(tool, "tool.go"))
-	js, _ := json.Marshal(infoSdk.ModTime().UnixNano() + infoSandbox.ModTime().UnixNano() + infoTool.ModTime().UnixNano())
+	js, _ := json.Marshal(infoSdk.ModTime().UnixNano() + infoSandbox.ModTime().UnixNano() + infoSandboxFns.ModTime().UnixNano() + infoTool.ModTime().UnixNano())
 
 	return js
 }
 
 func CompileTool(tool string) error {
-	toolPath := filepath.Join(tool, "tool.go")
 	mainPath := filepath.Join(tool, "main.go")
 	sandboxPath := filepath.Join(tool, "sandbox.go")
 	iniPath := filepath.Join(tool, "ini")
 	binPath := filepath.Join(tool, "bin")
 
-	//apply sandbox
+	//remove old bin
 	{
-		codeOrig, err := os.ReadFile(toolPath)
-		if err != nil {
-			return err
-		}
-		codeNew := []byte(ApplySandbox(string(codeOrig)))
-		if !bytes.Equal(codeOrig, codeNew) {
-			os.WriteFile(toolPath, codeNew, 0644)
-		}
+		os.Remove(binPath)
 	}
 
 	//copy sdk into tool
-
 	{
 		sdk, err := os.ReadFile("tools/sdk.go")
 		if err != nil {
@@ -115,31 +106,43 @@ func CompileTool(tool string) error {
 		}
 	}
 
-	//remove old bin
-	{
-		os.Remove(binPath)
-	}
-
 	//remove main.go
 	defer func() {
 		os.Remove(mainPath)
 		os.Remove(sandboxPath)
 	}()
 
-	//fix files
+	//apply sandbox
 	{
-		fmt.Printf("Fixing %s ... ", tool)
-		st := float64(time.Now().UnixMilli()) / 1000
-		cmd := exec.Command("goimports", "-l", "-w", ".")
-		cmd.Dir = tool
-		var stderr bytes.Buffer
-		cmd.Stderr = &stderr //os.Stderr
-		cmd.Stdout = os.Stdout
-		err := cmd.Run()
+		err := CheckToolSources(tool)
 		if err != nil {
-			return fmt.Errorf("goimports failed: %s", stderr.String())
+			return fmt.Errorf("sandbox rejected code: %w", err)
+		}
+
+		//goimports adds missing imports, so it must run before sandbox, otherwise os.WriteFile() without import would stay unchanged
+		err = _compileTool_goimports(tool)
+		if err != nil {
+			return err
+		}
+
+		changed, err := _compileTool_sandbox(tool, false)
+		if err != nil {
+			return fmt.Errorf("sandbox rejected code: %w", err)
+		}
+
+		if changed {
+			//removes imports, which are not used after rewrite
+			err = _compileTool_goimports(tool)
+			if err != nil {
+				return err
+			}
+
+			//goimports must not add anything, which sandbox would change
+			_, err = _compileTool_sandbox(tool, true)
+			if err != nil {
+				return fmt.Errorf("sandbox rejected code: %w", err)
+			}
 		}
-		fmt.Printf("done in %.3fsec\n", (float64(time.Now().UnixMilli())/1000)-st)
 	}
 
 	//update packages
@@ -153,17 +156,26 @@ func CompileTool(tool string) error {
 		cmd.Stdout = os.Stdout
 		err := cmd.Run()
 		if err != nil {
-			return fmt.Errorf("goimports failed: %s", stderr.String())
+			return fmt.Errorf("go mod tidy failed: %s", stderr.String())
 		}
 		fmt.Printf("done in %.3fsec\n", (float64(time.Now().UnixMilli())/1000)-st)
 	}
 
+	//check dependencies
+	{
+		err := _compileTool_checkDeps(tool)
+		if err != nil {
+			return fmt.Errorf("sandbox rejected code: %w", err)
+		}
+	}
+
 	//compile
 	{
 		fmt.Printf("Compiling %s ... ", tool)
 		st := float64(time.Now().UnixMilli()) / 1000
 		cmd := exec.Command("go", "build", "-o", "bin")
 		cmd.Dir = tool
+		cmd.Env = append(os.Environ(), "CGO_ENABLED=0") //C code is not sandboxed
 		var stderr bytes.Buffer
 		cmd.Stderr = &stderr //os.Stderr
 		cmd.Stdout = os.Stdout
@@ -182,32 +194,83 @@ func CompileTool(tool string) error {
 	return nil
 }
 
-func ApplySandbox(code string) string {
-	fl, err := os.ReadFile("tools/sdk_sandbox_fns.txt")
+// Runs goimports on tool's folder.
+func _compileTool_goimports(tool string) error {
+	fmt.Printf("Fixing %s ... ", tool)
+	st := float64(time.Now().UnixMilli()) / 1000
+	cmd := exec.Command("goimports", "-l", "-w", ".")
+	cmd.Dir = tool
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr //os.Stderr
+	cmd.Stdout = os.Stdout
+	err := cmd.Run()
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("goimports failed: %s", stderr.String())
+	}
+	fmt.Printf("done in %.3fsec\n", (float64(time.Now().UnixMilli())/1000)-st)
+	return nil
+}
+
+// Sandbox rewrites only tool's own files, so every package which is compiled into tool(also indirectly) must be from standard library.
+func _compileTool_checkDeps(tool string) error {
+	cmd := exec.Command("go", "list", "-deps", "-f", "{{if and .DepOnly (not .Standard)}}{{.ImportPath}}{{end}}", ".")
+	cmd.Dir = tool
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0") //same as compile
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("go list failed: %s", stderr.String())
 	}
 
-	lines := strings.Split(string(fl), "\n")
-	for _, ln := range lines {
-		if ln == "" {
-			continue //skip
+	deps := strings.Fields(string(out))
+	if len(deps) > 0 {
+		return fmt.Errorf("%s: packages %s are not in standard library", tool, strings.Join(deps, ", "))
+	}
+	return nil
+}
+
+// Applies sandbox on every tool's .go file. verify = files must not change. Returns true if some file was changed.
+func _compileTool_sandbox(tool string, verify bool) (bool, error) {
+	//every .go file is compiled, not only tool.go
+	files, err := filepath.Glob(filepath.Join(tool, "*.go"))
+	if err != nil {
+		return false, err
+	}
+
+	changed := false
+	for _, path := range files {
+		if path == filepath.Join(tool, "main.go") || path == filepath.Join(tool, "sandbox.go") {
+			continue //generated from sdk
 		}
-		var src, dst string
-		n, err := fmt.Sscanf(ln, "%s %s", &src, &dst)
-		if n != 2 || err != nil {
-			log.Fatal(err)
+
+		codeOrig, err := os.ReadFile(path)
+		if err != nil {
+			return false, err
+		}
+		codeSandboxed, err := ApplySandbox(filepath.Base(path), string(codeOrig))
+		if err != nil {
+			return false, err
+		}
+		codeNew := []byte(codeSandboxed)
+		if bytes.Equal(codeOrig, codeNew) {
+			continue
 		}
 
-		code = strings.ReplaceAll(code, src, dst)
+		if verify {
+			return false, fmt.Errorf("%s: code changed after goimports", path)
+		}
+		err = os.WriteFile(path, codeNew, 0644)
+		if err != nil {
+			return false, err
+		}
+		changed = true
 	}
-
-	return code
+	return changed, nil
 }
 
 func ConvertFileIntoTool(tool string) (*OpenAI_completion_tool, *Anthropic_completion_tool, error) {
 	stName := filepath.Base(tool)
-
 	toolPath := filepath.Join(tool, "tool.go")
 
 	node, err := parser.ParseFile(token.NewFileSet(), toolPath, nil, parser.ParseComments)